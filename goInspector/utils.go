@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"sort"
 	"strconv"
 
 	"github.com/ethereum/go-ethereum/accounts/keystore"
@@ -54,24 +55,15 @@ func PrintTransactionsInBlock(client *ethclient.Client) {
 		return
 	}
 
+	chainID, err := client.ChainID(context.Background())
+	if err != nil {
+		fmt.Println("Get transaction failed: ", err)
+		return
+	}
+
 	for idx, tx := range block.Transactions() {
 		fmt.Printf("Transaction %v:\n{\n", idx)
-		fmt.Printf("  Hash: %s,\n", tx.Hash().Hex())
-		fmt.Printf("  Value: %s,\n", tx.Value().String())
-		fmt.Printf("  Gas: %v,\n", tx.Gas())
-		fmt.Printf("  GasPrice: %v,\n", tx.GasPrice().Uint64())
-		fmt.Printf("  Nonce: %v,\n", tx.Nonce())
-		fmt.Printf("  To: %s,\n", tx.To().Hex())
-
-		chainID, err := client.NetworkID(context.Background())
-		if err != nil {
-			fmt.Println("Get transaction failed: ", err)
-			return
-		}
-
-		if msg, err := tx.AsMessage(types.NewEIP155Signer(chainID)); err == nil {
-			fmt.Printf("  From: %s,\n", msg.From().Hex())
-		}
+		PrintTransactionFields(tx, chainID)
 
 		receipt, err := client.TransactionReceipt(context.Background(), tx.Hash())
 		if err != nil {
@@ -79,6 +71,8 @@ func PrintTransactionsInBlock(client *ethclient.Client) {
 			return
 		}
 
+		fmt.Printf("  EffectiveGasPrice: %s,\n", EffectiveGasPrice(tx, block.BaseFee()).String())
+		fmt.Printf("  GasUsed: %v,\n", receipt.GasUsed)
 		fmt.Printf("  Status: %v,\n}\n", receipt.Status)
 	}
 }
@@ -95,26 +89,75 @@ func PrintTransactionByHash(client *ethclient.Client) {
 		return
 	}
 
-	fmt.Printf("{\n  Hash: %s,\n", tx.Hash().Hex())
-	fmt.Printf("  Value: %s,\n", tx.Value().String())
-	fmt.Printf("  Gas: %v,\n", tx.Gas())
-	fmt.Printf("  GasPrice: %v,\n", tx.GasPrice().Uint64())
-	fmt.Printf("  Nonce: %v,\n", tx.Nonce())
-	fmt.Printf("  To: %s,\n", tx.To().Hex())
-
-	chainID, err := client.NetworkID(context.Background())
+	chainID, err := client.ChainID(context.Background())
 	if err != nil {
 		fmt.Println("Get transaction failed: ", err)
 		return
 	}
 
-	if msg, err := tx.AsMessage(types.NewEIP155Signer(chainID)); err == nil {
-		fmt.Printf("  From: %s,\n", msg.From().Hex())
+	fmt.Printf("{\n")
+	PrintTransactionFields(tx, chainID)
+
+	if !isPending {
+		receipt, err := client.TransactionReceipt(context.Background(), txHash)
+		if err != nil {
+			fmt.Println("Get transaction failed: ", err)
+			return
+		}
+
+		header, err := client.HeaderByNumber(context.Background(), receipt.BlockNumber)
+		if err != nil {
+			fmt.Println("Get transaction failed: ", err)
+			return
+		}
+
+		fmt.Printf("  EffectiveGasPrice: %s,\n", EffectiveGasPrice(tx, header.BaseFee).String())
+		fmt.Printf("  GasUsed: %v,\n", receipt.GasUsed)
 	}
 
 	fmt.Printf("  IsPending: %v,\n}\n", isPending)
 }
 
+// PrintTransactionFields : print the fields of a transaction shared by block and hash lookups,
+// the fee fields follow the transaction type and the sender is recovered with the chain id
+func PrintTransactionFields(tx *types.Transaction, chainID *big.Int) {
+	fmt.Printf("  Hash: %s,\n", tx.Hash().Hex())
+	fmt.Printf("  Type: %v,\n", tx.Type())
+	fmt.Printf("  Value: %s,\n", tx.Value().String())
+	fmt.Printf("  Gas: %v,\n", tx.Gas())
+	if tx.Type() == types.DynamicFeeTxType {
+		fmt.Printf("  MaxFeePerGas: %s,\n", tx.GasFeeCap().String())
+		fmt.Printf("  MaxPriorityFeePerGas: %s,\n", tx.GasTipCap().String())
+	} else {
+		fmt.Printf("  GasPrice: %v,\n", tx.GasPrice().Uint64())
+	}
+	fmt.Printf("  Nonce: %v,\n", tx.Nonce())
+	if to := tx.To(); to != nil {
+		fmt.Printf("  To: %s,\n", to.Hex())
+	} else {
+		fmt.Printf("  To: contract creation,\n")
+	}
+
+	if from, err := types.Sender(types.LatestSignerForChainID(chainID), tx); err == nil {
+		fmt.Printf("  From: %s,\n", from.Hex())
+	}
+}
+
+// EffectiveGasPrice : returns the price per gas a mined transaction paid, base fee plus the
+// effective tip, or the plain gas price before london when the block has no base fee
+func EffectiveGasPrice(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return tx.GasPrice()
+	}
+
+	tip, err := tx.EffectiveGasTip(baseFee)
+	if err != nil {
+		return tx.GasPrice()
+	}
+
+	return tip.Add(tip, baseFee)
+}
+
 func SendTransaction(client *ethclient.Client) {
 	var privateKeyFile, password string
 	fmt.Println("Please input your key file path:")
@@ -181,32 +224,75 @@ func SendTransaction(client *ethclient.Client) {
 	}
 	gasLimit := uint64(gasLimitInt)
 
-	var gasPriceStr string
-	fmt.Println("(Transaction Config) Please input gas price:")
-	fmt.Scanln(&gasPriceStr)
-	gasPrice := new(big.Int)
-	gasPrice, ok = gasPrice.SetString(gasPriceStr, 10)
-
-	if !ok {
-		fmt.Println("Invalid input.")
+	header, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		fmt.Println("Send transaction failed: ", err)
 		return
 	}
 
+	var gasPrice, gasFeeCap, gasTipCap *big.Int
+	if header.BaseFee == nil {
+		var gasPriceStr string
+		fmt.Println("(Transaction Config) Please input gas price:")
+		fmt.Scanln(&gasPriceStr)
+		gasPrice = new(big.Int)
+		gasPrice, ok = gasPrice.SetString(gasPriceStr, 10)
+
+		if !ok {
+			fmt.Println("Invalid input.")
+			return
+		}
+	} else {
+		suggestedFeeCap, suggestedTipCap, err := SuggestDynamicFees(client, header.BaseFee)
+		if err != nil {
+			fmt.Println("Send transaction failed: ", err)
+			return
+		}
+
+		fmt.Printf("(Transaction Config) Please input max fee per gas (if skipped, it will be set as %s):\n", suggestedFeeCap.String())
+		gasFeeCap = ScanBigInt(suggestedFeeCap)
+		if gasFeeCap == nil {
+			fmt.Println("Invalid input.")
+			return
+		}
+
+		fmt.Printf("(Transaction Config) Please input max priority fee per gas (if skipped, it will be set as %s):\n", suggestedTipCap.String())
+		gasTipCap = ScanBigInt(suggestedTipCap)
+		if gasTipCap == nil {
+			fmt.Println("Invalid input.")
+			return
+		}
+	}
+
 	var accountstr string
 	fmt.Println("(Transaction Config) Please input recipient account address:")
 	fmt.Scanln(&accountstr)
 	toAddress := common.HexToAddress(accountstr)
 
-	var data []byte
-	tx := types.NewTransaction(nonce, toAddress, value, gasLimit, gasPrice, data)
-
-	chainID, err := client.NetworkID(context.Background())
+	chainID, err := client.ChainID(context.Background())
 	if err != nil {
 		fmt.Println("Send transaction failed: ", err)
 		return
 	}
 
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), privateKey)
+	var data []byte
+	var tx *types.Transaction
+	if gasFeeCap == nil {
+		tx = types.NewTransaction(nonce, toAddress, value, gasLimit, gasPrice, data)
+	} else {
+		tx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			GasTipCap: gasTipCap,
+			GasFeeCap: gasFeeCap,
+			Gas:       gasLimit,
+			To:        &toAddress,
+			Value:     value,
+			Data:      data,
+		})
+	}
+
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), privateKey)
 	if err != nil {
 		fmt.Println("Send transaction failed: ", err)
 		return
@@ -221,6 +307,60 @@ func SendTransaction(client *ethclient.Client) {
 	fmt.Println("Transaction has been sent, hash: ", signedTx.Hash().Hex())
 }
 
+// SuggestDynamicFees : returns a suggested max fee and max priority fee per gas, the tip is the
+// median of the recent median rewards and the max fee leaves room for the base fee to double
+func SuggestDynamicFees(client *ethclient.Client, baseFee *big.Int) (*big.Int, *big.Int, error) {
+	history, err := client.FeeHistory(context.Background(), 20, nil, []float64{50})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rewards := []*big.Int{}
+	for _, reward := range history.Reward {
+		if len(reward) > 0 && reward[0] != nil {
+			rewards = append(rewards, reward[0])
+		}
+	}
+
+	var tip *big.Int
+	if len(rewards) > 0 {
+		sort.Slice(rewards, func(i, j int) bool { return rewards[i].Cmp(rewards[j]) < 0 })
+		tip = new(big.Int).Set(rewards[len(rewards)/2])
+	}
+	if tip == nil || tip.Sign() == 0 {
+		tip, err = client.SuggestGasTipCap(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(history.BaseFee) > 0 {
+		baseFee = history.BaseFee[len(history.BaseFee)-1]
+	}
+
+	feeCap := new(big.Int).Mul(baseFee, big.NewInt(2))
+	feeCap.Add(feeCap, tip)
+
+	return feeCap, tip, nil
+}
+
+// ScanBigInt : read a decimal integer from stdin, returns defaultValue on empty input
+// and nil when the input is not a valid integer
+func ScanBigInt(defaultValue *big.Int) *big.Int {
+	var valueStr string
+	_, err := fmt.Scanln(&valueStr)
+	if err != nil || valueStr == "" {
+		return defaultValue
+	}
+
+	value, ok := new(big.Int).SetString(valueStr, 10)
+	if !ok {
+		return nil
+	}
+
+	return value
+}
+
 func GetPrivateKey(privateKeyFile, password *string) string {
 	keyJSON, err := ioutil.ReadFile(*privateKeyFile)
 	if err != nil {
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Admin : an admin account, the password is only stored as a bcrypt hash
+// role
+//  operator: may run centralize, deposit scans, replacements, offline batches and reconciliation
+//  auditor: may only read, view reconciliation reports and the audit log, but not write adjustments
+//  superadmin: may do everything, including managing admins
+type Admin struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordhash"`
+	Role         string `json:"role"`
+}
+
+// AuditEntry : an admin action and its outcome
+type AuditEntry struct {
+	ID     uint64 `json:"id"`
+	Time   int64  `json:"time"`
+	Actor  string `json:"actor"`
+	Role   string `json:"role"`
+	Action string `json:"action"`
+	Detail string `json:"detail"`
+	Result string `json:"result"`
+}
+
+// permissions : the admin roles allowed to run each action
+var permissions = map[string][]string{
+	"centralize": {"operator", "superadmin"},
+	"scan":       {"operator", "superadmin"},
+	"replace":    {"operator", "superadmin"},
+	"offline":    {"operator", "superadmin"},
+	"approve":    {"operator", "superadmin"},
+	"override":   {"operator", "superadmin"},
+	"rebalance":  {"operator", "superadmin"},
+	"report":     {"operator", "auditor", "superadmin"},
+	"reconcile":  {"operator", "superadmin"},
+	"audit":      {"auditor", "superadmin"},
+	"manage":     {"superadmin"},
+}
+
+// HasAdmins : returns true if at least one admin account exists
+func HasAdmins() (bool, error) {
+	var names []string
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		names, err = tx.Keys(BucketAdmins)
+		return err
+	})
+	if err != nil {
+		return false, errors.New("fail to open admins: " + err.Error())
+	}
+
+	return len(names) > 0, nil
+}
+
+// GetAdmins : returns all admin accounts
+func GetAdmins() ([]Admin, error) {
+	admins := []Admin{}
+	err := store.View(func(tx StorageTx) error {
+		names, err := tx.Keys(BucketAdmins)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			var admin Admin
+			if _, err := tx.Get(BucketAdmins, name, &admin); err != nil {
+				return err
+			}
+			admins = append(admins, admin)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open admins: " + err.Error())
+	}
+
+	return admins, nil
+}
+
+// CreateAdmin : add an admin account with role
+func CreateAdmin(name, password, role string) error {
+	admin, err := newAdmin(name, password, role)
+	if err != nil {
+		return err
+	}
+
+	return store.Update(func(tx StorageTx) error {
+		var existing Admin
+		found, err := tx.Get(BucketAdmins, name, &existing)
+		if err != nil {
+			return err
+		}
+		if found {
+			return errors.New("admin " + name + " already exists")
+		}
+
+		return tx.Put(BucketAdmins, name, admin)
+	})
+}
+
+// CreateFirstAdmin : add the superadmin of a system without admins, it fails once any admin exists
+func CreateFirstAdmin(name, password string) error {
+	admin, err := newAdmin(name, password, "superadmin")
+	if err != nil {
+		return err
+	}
+
+	return store.Update(func(tx StorageTx) error {
+		names, err := tx.Keys(BucketAdmins)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return errors.New("admins already exist, ask a superadmin to add more")
+		}
+
+		return tx.Put(BucketAdmins, name, admin)
+	})
+}
+
+// newAdmin : returns a checked admin account with the hash of password
+func newAdmin(name, password, role string) (*Admin, error) {
+	if name == "" {
+		return nil, errors.New("admin name is empty")
+	}
+	if len(password) < 8 {
+		return nil, errors.New("password must have at least 8 characters")
+	}
+	if role != "operator" && role != "auditor" && role != "superadmin" {
+		return nil, errors.New("unknown role " + role)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, errors.New("fail to hash password: " + err.Error())
+	}
+
+	return &Admin{Name: name, PasswordHash: string(hash), Role: role}, nil
+}
+
+// RemoveAdmin : remove an admin account and its sessions, the last superadmin cannot be removed
+func RemoveAdmin(name string) error {
+	return store.Update(func(tx StorageTx) error {
+		names, err := tx.Keys(BucketAdmins)
+		if err != nil {
+			return err
+		}
+
+		var target *Admin
+		superadmins := 0
+		for _, n := range names {
+			var admin Admin
+			if _, err := tx.Get(BucketAdmins, n, &admin); err != nil {
+				return err
+			}
+			if admin.Role == "superadmin" {
+				superadmins++
+			}
+			if n == name {
+				target = &admin
+			}
+		}
+
+		if target == nil {
+			return errors.New("no such admin " + name)
+		}
+		if target.Role == "superadmin" && superadmins == 1 {
+			return errors.New("the last superadmin cannot be removed")
+		}
+
+		// end the sessions of the removed admin right away
+		tokens, err := tx.Keys(BucketSessions)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			var session Session
+			if _, err := tx.Get(BucketSessions, token, &session); err != nil {
+				return err
+			}
+			if session.Role != "user" && session.Name == name {
+				if err := tx.Delete(BucketSessions, token); err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Delete(BucketAdmins, name)
+	})
+}
+
+// LoginAdmin : log in as an admin, returns a session with the admin's role
+func LoginAdmin(name, password string) (*Session, error) {
+	var admin Admin
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketAdmins, name, &admin)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("fail to open admins: " + err.Error())
+	}
+
+	// the same answer for unknown names and wrong passwords
+	if !found || bcrypt.CompareHashAndPassword([]byte(admin.PasswordHash), []byte(password)) != nil {
+		return nil, errors.New("wrong name or password")
+	}
+
+	return NewSession("", admin.Name, admin.Role)
+}
+
+// Allow : returns an error unless the session is still valid and its role may run action
+func (s *Session) Allow(action string) error {
+	if s == nil {
+		return errors.New("not logged in")
+	}
+
+	current, err := GetSession(s.Token)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range permissions[action] {
+		if current.Role == role {
+			return nil
+		}
+	}
+
+	return errors.New("permission denied: " + current.Role + " may not " + action)
+}
+
+// Audit : append an admin action and its outcome to the audit log
+func Audit(session *Session, action, detail string, result error) error {
+	entry := AuditEntry{
+		Time:   time.Now().Unix(),
+		Actor:  session.Name,
+		Role:   session.Role,
+		Action: action,
+		Detail: detail,
+		Result: "ok",
+	}
+	if result != nil {
+		entry.Result = result.Error()
+	}
+
+	return store.Update(func(tx StorageTx) error {
+		id, err := tx.NextID(BucketAudit)
+		if err != nil {
+			return err
+		}
+
+		entry.ID = id
+		return tx.Put(BucketAudit, fmt.Sprintf("%016d", id), &entry)
+	})
+}
+
+// GetAuditLog : returns the last count entries of the audit log, oldest first
+func GetAuditLog(count int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := store.View(func(tx StorageTx) error {
+		keys, err := tx.Keys(BucketAudit)
+		if err != nil {
+			return err
+		}
+		if len(keys) > count {
+			keys = keys[len(keys)-count:]
+		}
+
+		for _, key := range keys {
+			var entry AuditEntry
+			if _, err := tx.Get(BucketAudit, key, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open audit log: " + err.Error())
+	}
+
+	return entries, nil
+}
+
+// FormatAuditEntry : returns an audit entry as one line
+func FormatAuditEntry(entry AuditEntry) string {
+	return strings.Join([]string{
+		time.Unix(entry.Time, 0).Format("2006-01-02 15:04:05"),
+		entry.Actor + "(" + entry.Role + ")",
+		entry.Action,
+		entry.Detail,
+		entry.Result,
+	}, "\t")
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// WithdrawRequest : a withdrawal above ApprovalThreshold waiting for admin approvals,
+// Reserved is kept from the user's pendingbalance until the withdrawal is sent or the request rejected
+// request status
+//  0: pending
+//  1: approved, sent once it has a Hash
+//  2: rejected
+//  3: approved but failed to send, it can still be exported and sent offline, or rejected
+type WithdrawRequest struct {
+	ID        uint64     `json:"id"`
+	Address   string     `json:"address"`
+	To        string     `json:"to"`
+	Value     string     `json:"value"`
+	Reserved  string     `json:"reserved"`
+	Created   int64      `json:"created"`
+	Status    string     `json:"status"`
+	Approvals []Approval `json:"approvals"`
+	Rejection *Approval  `json:"rejection,omitempty"`
+	Hash      string     `json:"hash,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Approval : an admin's decision on a withdraw request, Reason is only set for rejections
+type Approval struct {
+	Admin  string `json:"admin"`
+	Time   int64  `json:"time"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RequestWithdrawal : withdraw value to to on behalf of address, right away if value is within
+// ApprovalThreshold, or as a pending request otherwise, exactly one of the results is not nil
+func RequestWithdrawal(client *ethclient.Client, address, to string, value *big.Int) (*MyTransaction, *WithdrawRequest, error) {
+	threshold, err := config.Threshold()
+	if err != nil {
+		return nil, nil, err
+	}
+	if threshold == nil || value.Cmp(threshold) <= 0 {
+		tx, err := WithdrawFunds(client, address, to, value)
+		return tx, nil, err
+	}
+
+	unlock := LockWithdrawal(address)
+	defer unlock()
+
+	required, err := checkFunds(client, address, to, value, new(big.Int))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request := WithdrawRequest{
+		Address:   strings.ToLower(address),
+		To:        strings.ToLower(to),
+		Value:     value.String(),
+		Reserved:  required.String(),
+		Created:   time.Now().Unix(),
+		Status:    "0",
+		Approvals: []Approval{},
+	}
+
+	err = store.Update(func(tx StorageTx) error {
+		id, err := tx.NextID(BucketWithdrawRequests)
+		if err != nil {
+			return err
+		}
+
+		request.ID = id
+		err = tx.Put(BucketWithdrawRequests, requestKey(id), &request)
+		if err != nil {
+			return err
+		}
+
+		// reserve the amount right away
+		info, err := GetAccountInfo(tx, address)
+		if err != nil {
+			return err
+		}
+		err = SyncBalances(tx, address, info)
+		if err != nil {
+			return err
+		}
+		return PutAccountInfo(tx, address, info)
+	})
+	if err != nil {
+		return nil, nil, errors.New("fail to save withdraw request: " + err.Error())
+	}
+
+	return nil, &request, nil
+}
+
+// GetWithdrawRequests : returns the withdraw requests of address, or of all users if address is empty,
+// only the pending ones if pending is set
+func GetWithdrawRequests(address string, pending bool) ([]WithdrawRequest, error) {
+	requests := []WithdrawRequest{}
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		requests, err = withdrawRequests(tx, address, pending)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("fail to open withdraw requests: " + err.Error())
+	}
+
+	return requests, nil
+}
+
+// ApproveRequest : record the approval of the session's admin, and send the withdrawal
+// once it has RequiredApprovals approvals from different admins
+func ApproveRequest(client *ethclient.Client, session *Session, id uint64) (*WithdrawRequest, error) {
+	var request WithdrawRequest
+	err := store.View(func(tx StorageTx) error {
+		found, err := tx.Get(BucketWithdrawRequests, requestKey(id), &request)
+		if err == nil && !found {
+			err = errors.New("no such withdraw request")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the user lock keeps the request and the user's other withdrawals in order
+	unlock := LockWithdrawal(request.Address)
+	defer unlock()
+
+	approved := false
+	err = updateRequest(id, func(request *WithdrawRequest) error {
+		if request.Status != "0" {
+			return errors.New("withdraw request is not pending")
+		}
+		for _, approval := range request.Approvals {
+			if approval.Admin == session.Name {
+				return errors.New("already approved by " + session.Name)
+			}
+		}
+
+		request.Approvals = append(request.Approvals, Approval{Admin: session.Name, Time: time.Now().Unix()})
+
+		// the request keeps its reservation until the withdrawal is sent
+		if len(request.Approvals) >= config.RequiredApprovals {
+			request.Status = "1"
+			approved = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if approved {
+		var hash string
+		value, failure := ParseAmount(request.Value)
+		if failure == nil {
+			var tx *MyTransaction
+			tx, failure = sendWithdrawal(client, request.Address, request.To, value, id)
+			if failure == nil {
+				hash = tx.Hash
+			}
+		}
+
+		err = updateRequest(id, func(request *WithdrawRequest) error {
+			if failure != nil {
+				request.Status = "3"
+				request.Error = failure.Error()
+			} else {
+				request.Hash = hash
+			}
+			return nil
+		})
+		if failure != nil {
+			return nil, errors.New("approved but fail to send: " + failure.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return getRequest(id)
+}
+
+// RejectRequest : reject a pending withdraw request, or an approved one that failed to send, for reason,
+// releasing its reservation
+func RejectRequest(session *Session, id uint64, reason string) (*WithdrawRequest, error) {
+	if reason == "" {
+		return nil, errors.New("a rejection needs a reason")
+	}
+
+	err := updateRequest(id, func(request *WithdrawRequest) error {
+		if request.Status != "0" && request.Status != "3" {
+			return errors.New("withdraw request is neither pending nor failed")
+		}
+
+		request.Status = "2"
+		request.Rejection = &Approval{Admin: session.Name, Time: time.Now().Unix(), Reason: reason}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return getRequest(id)
+}
+
+// checkApproval : returns an error unless a withdrawal within ApprovalThreshold, or the withdrawal
+// of the withdraw request id once it is approved and not sent yet, otherwise the amount the request reserves
+// an approved request is status 1 while it is being sent online, or status 3 if that failed,
+// in which case it can still be sent offline
+func checkApproval(address, to string, value *big.Int, id uint64) (*big.Int, error) {
+	threshold, err := config.Threshold()
+	if err != nil {
+		return nil, err
+	}
+	if threshold == nil || value.Cmp(threshold) <= 0 {
+		return new(big.Int), nil
+	}
+	if id == 0 {
+		return nil, errors.New("a withdrawal above the approval threshold needs an approved withdraw request")
+	}
+
+	request, err := getRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(request.Address, address) || !strings.EqualFold(request.To, to) || request.Value != value.String() {
+		return nil, fmt.Errorf("the withdrawal does not match withdraw request #%d", id)
+	}
+	if (request.Status != "1" && request.Status != "3") || len(request.Approvals) < config.RequiredApprovals {
+		return nil, fmt.Errorf("withdraw request #%d is not approved", id)
+	}
+	if request.Hash != "" {
+		return nil, fmt.Errorf("withdraw request #%d is already sent", id)
+	}
+
+	return ParseAmount(request.Reserved)
+}
+
+// RequestSent : record that the withdrawal of an approved withdraw request was sent offline as hash
+func RequestSent(id uint64, hash string) error {
+	return updateRequest(id, func(request *WithdrawRequest) error {
+		request.Status = "1"
+		request.Hash = hash
+		request.Error = ""
+		return nil
+	})
+}
+
+// RequestedBalance : returns the amount the withdraw requests of address keep from its balance,
+// pending ones and approved ones whose withdrawal is not sent yet
+func RequestedBalance(stx StorageTx, address string) (*big.Int, error) {
+	requests, err := withdrawRequests(stx, address, false)
+	if err != nil {
+		return nil, err
+	}
+
+	requested := new(big.Int)
+	for _, request := range requests {
+		if request.Status == "2" || request.Hash != "" {
+			continue
+		}
+
+		amount, err := ParseAmount(request.Reserved)
+		if err != nil {
+			return nil, err
+		}
+		requested.Add(requested, amount)
+	}
+
+	return requested, nil
+}
+
+// FormatWithdrawRequest : returns a withdraw request as one line
+func FormatWithdrawRequest(request WithdrawRequest) string {
+	approvers := []string{}
+	for _, approval := range request.Approvals {
+		approvers = append(approvers, approval.Admin)
+	}
+
+	return fmt.Sprintf("#%d\t%s\t%s -> %s\t%s\tapproved by [%s]\t%s",
+		request.ID, time.Unix(request.Created, 0).Format("2006-01-02 15:04:05"),
+		request.Address, request.To, request.Value, strings.Join(approvers, ", "), requestStatus(request))
+}
+
+func requestStatus(request WithdrawRequest) string {
+	switch request.Status {
+	case "0":
+		return "pending"
+	case "1":
+		return "sent " + request.Hash
+	case "2":
+		return "rejected by " + request.Rejection.Admin + ": " + request.Rejection.Reason
+	default:
+		return "failed: " + request.Error
+	}
+}
+
+func withdrawRequests(stx StorageTx, address string, pending bool) ([]WithdrawRequest, error) {
+	keys, err := stx.Keys(BucketWithdrawRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := []WithdrawRequest{}
+	for _, key := range keys {
+		var request WithdrawRequest
+		if _, err := stx.Get(BucketWithdrawRequests, key, &request); err != nil {
+			return nil, err
+		}
+		if address != "" && !strings.EqualFold(request.Address, address) {
+			continue
+		}
+		if pending && request.Status != "0" {
+			continue
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
+
+func getRequest(id uint64) (*WithdrawRequest, error) {
+	var request WithdrawRequest
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketWithdrawRequests, requestKey(id), &request)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("fail to open withdraw request: " + err.Error())
+	}
+	if !found {
+		return nil, errors.New("no such withdraw request")
+	}
+
+	return &request, nil
+}
+
+// updateRequest : apply fn to a withdraw request and save it with the user's refreshed reservation
+func updateRequest(id uint64, fn func(request *WithdrawRequest) error) error {
+	return store.Update(func(tx StorageTx) error {
+		var request WithdrawRequest
+		found, err := tx.Get(BucketWithdrawRequests, requestKey(id), &request)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New("no such withdraw request")
+		}
+
+		err = fn(&request)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Put(BucketWithdrawRequests, requestKey(id), &request)
+		if err != nil {
+			return err
+		}
+
+		info, err := GetAccountInfo(tx, request.Address)
+		if err != nil {
+			return err
+		}
+		err = SyncBalances(tx, request.Address, info)
+		if err != nil {
+			return err
+		}
+		return PutAccountInfo(tx, request.Address, info)
+	})
+}
+
+func requestKey(id uint64) string {
+	return fmt.Sprintf("%016d", id)
+}
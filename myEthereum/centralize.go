@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// CentralizeJob : a centralize run persisted with the state of each address after every step,
+// so that a crash or an error leaves a record that can be resumed
+type CentralizeJob struct {
+	ID      uint64      `json:"id"`
+	Admin   string      `json:"admin"`
+	Created int64       `json:"created"`
+	Updated int64       `json:"updated"`
+	Items   []SweepItem `json:"items"`
+}
+
+// centralizelock keeps two runs from planning the same addresses
+var centralizelock sync.Mutex
+
+// Status : returns the status of a job, following from the state of its items
+//  running: some items are planned or signed, the run was interrupted if it is not going on
+//  broadcast: every transaction is sent, some are not settled yet
+//  done: every item is confirmed, failed or skipped, failed ones can be resumed
+func (j *CentralizeJob) Status() string {
+	status := "done"
+	for _, item := range j.Items {
+		switch item.State {
+		case "planned", "signed":
+			return "running"
+		case "broadcast":
+			status = "broadcast"
+		}
+	}
+
+	return status
+}
+
+// StartCentralize : sweep every assigned address to the hot wallet as a new job,
+// one address failing does not stop the others
+func StartCentralize(client *ethclient.Client, session *Session) (*CentralizeJob, error) {
+	centralizelock.Lock()
+	defer centralizelock.Unlock()
+
+	// an interrupted job still holds signed transactions
+	jobs, err := GetCentralizeJobs(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) > 0 && jobs[0].Status() == "running" {
+		return nil, fmt.Errorf("centralize job #%d was interrupted, resume it first", jobs[0].ID)
+	}
+
+	// settle earlier sweeps first
+	info, ok := RefreshAllAccount(client)
+	if !ok {
+		return nil, errors.New("fail to refresh balance")
+	}
+
+	job := CentralizeJob{Admin: session.Name, Created: time.Now().Unix(), Items: []SweepItem{}}
+	for _, userinfo := range *info {
+		job.Items = append(job.Items, SweepItem{Address: strings.ToLower(userinfo["address"]), State: "planned"})
+	}
+
+	err = store.Update(func(tx StorageTx) error {
+		id, err := tx.NextID(BucketCentralizeJobs)
+		if err != nil {
+			return err
+		}
+
+		job.ID = id
+		return tx.Put(BucketCentralizeJobs, jobKey(id), &job)
+	})
+	if err != nil {
+		return nil, errors.New("fail to save centralize job: " + err.Error())
+	}
+
+	return runJob(client, &job)
+}
+
+// ResumeCentralize : continue a job where it stopped, broadcasting what was signed
+// and planning the failed addresses again
+func ResumeCentralize(client *ethclient.Client, id uint64) (*CentralizeJob, error) {
+	centralizelock.Lock()
+	defer centralizelock.Unlock()
+
+	job, err := GetCentralizeJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return runJob(client, job)
+}
+
+// runJob : take every item of a job as far as it goes, saving the job after each step
+func runJob(client *ethclient.Client, job *CentralizeJob) (*CentralizeJob, error) {
+	block, err := confirmedHead(client)
+	if err != nil {
+		return job, err
+	}
+
+	for i := range job.Items {
+		item := &job.Items[i]
+
+		if item.State == "planned" || item.State == "failed" {
+			// a run stopped between planning and signing left the nonce reserved
+			if item.State == "planned" && item.Tx != nil {
+				ReleaseNonce(item.Tx.From, item.Tx.Nonce)
+			}
+
+			*item = planItem(client, item.Address, block)
+			err = putJob(job)
+			if err != nil {
+				return job, err
+			}
+		}
+
+		if item.State == "planned" {
+			signItem(item)
+			err = putJob(job)
+			if err != nil {
+				return job, err
+			}
+		}
+
+		if item.State == "signed" {
+			broadcastSweep(client, item)
+			err = putJob(job)
+			if err != nil {
+				return job, err
+			}
+		}
+	}
+
+	err = refreshJob(client, job)
+	if err != nil {
+		return job, err
+	}
+
+	return job, putJob(job)
+}
+
+// planItem : plan the next transaction of a deposit address, a failure is kept in the item
+func planItem(client *ethclient.Client, address string, block *big.Int) SweepItem {
+	item, err := planSweep(client, address, block)
+	if err != nil {
+		return SweepItem{Address: address, State: "failed", Error: err.Error()}
+	}
+
+	return *item
+}
+
+// signItem : sign a planned item, with the key of the gas station for a gas funding
+func signItem(item *SweepItem) {
+	privateKey, err := LoadPrivateKey(item.Tx.From)
+	if err == nil {
+		err = item.Tx.Sign(privateKey)
+	}
+	if err != nil {
+		ReleaseNonce(item.Tx.From, item.Tx.Nonce)
+		item.State = "failed"
+		item.Error = "fail to sign: " + err.Error()
+		return
+	}
+
+	item.State = "signed"
+}
+
+// broadcastSweep : send a signed item and save it to the ledger, a transaction that reached
+// the node or the ledger before a crash is not sent or saved twice
+func broadcastSweep(client *ethclient.Client, item *SweepItem) {
+	signedTx, err := item.Tx.Signed()
+	if err != nil {
+		item.State = "failed"
+		item.Error = err.Error()
+		return
+	}
+
+	saved, err := ledgerHas(item.Tx.Ledger, signedTx.Hash().Hex())
+	if err != nil {
+		item.Error = err.Error()
+		return
+	}
+	if saved {
+		item.State = "broadcast"
+		item.Error = ""
+		return
+	}
+
+	err = client.SendTransaction(context.Background(), signedTx)
+	if err != nil {
+		if _, _, known := client.TransactionByHash(context.Background(), signedTx.Hash()); known != nil {
+			ReleaseSentNonce(client, item.Tx.From, item.Tx.Nonce, err)
+			item.State = "failed"
+			item.Error = "fail to broadcast: " + err.Error()
+			return
+		}
+	}
+
+	mytx, err := DecomposeTransaction(client, signedTx, item.Tx.Type)
+	if err == nil {
+		mytx.GasEstimate = item.Tx.GasEstimate
+		if item.Action == "token" {
+			mytx.Token = item.Token
+			mytx.TokenAmount = item.Amount
+		}
+		err = SaveATransaction(item.Tx.Ledger, mytx)
+	}
+	if err != nil {
+		// still signed, resuming saves it
+		item.Error = "sent but fail to save: " + err.Error()
+		return
+	}
+
+	item.State = "broadcast"
+	item.Error = ""
+}
+
+// refreshJob : settle the broadcast items of a job, confirmed once settled and failed if they moved nothing
+func refreshJob(client *ethclient.Client, job *CentralizeJob) error {
+	refreshed := make(map[string]bool)
+	for i := range job.Items {
+		item := &job.Items[i]
+		if item.State != "broadcast" {
+			continue
+		}
+
+		if !refreshed[item.Tx.Ledger] {
+			_, _, err := RefreshAccountInfo(client, item.Tx.Ledger)
+			if err != nil {
+				return err
+			}
+			refreshed[item.Tx.Ledger] = true
+		}
+
+		err := store.View(func(tx StorageTx) error {
+			info, err := GetAccountInfo(tx, item.Tx.Ledger)
+			if err != nil {
+				return err
+			}
+
+			for _, t := range info.Transactions {
+				if !strings.EqualFold(t.Hash, item.Tx.Hash) {
+					continue
+				}
+
+				switch t.Status {
+				case "1":
+					item.State = "confirmed"
+				case "2":
+					item.State, item.Error = "failed", "reverted"
+				case "3":
+					item.State, item.Error = "failed", "dropped"
+				case "4":
+					item.State, item.Error = "failed", "replaced"
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return errors.New("fail to open account info: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// GetCentralizeJob : returns the centralize job id
+func GetCentralizeJob(id uint64) (*CentralizeJob, error) {
+	var job CentralizeJob
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketCentralizeJobs, jobKey(id), &job)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("fail to open centralize job: " + err.Error())
+	}
+	if !found {
+		return nil, errors.New("no such centralize job")
+	}
+
+	return &job, nil
+}
+
+// GetCentralizeJobs : returns the last count centralize jobs, the latest first
+func GetCentralizeJobs(count int) ([]CentralizeJob, error) {
+	jobs := []CentralizeJob{}
+	err := store.View(func(tx StorageTx) error {
+		keys, err := tx.Keys(BucketCentralizeJobs)
+		if err != nil {
+			return err
+		}
+		if len(keys) > count {
+			keys = keys[len(keys)-count:]
+		}
+
+		for i := len(keys) - 1; i >= 0; i-- {
+			var job CentralizeJob
+			if _, err := tx.Get(BucketCentralizeJobs, keys[i], &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open centralize jobs: " + err.Error())
+	}
+
+	return jobs, nil
+}
+
+// FormatJobSummary : returns the outcome of a job as one line
+func FormatJobSummary(job CentralizeJob) string {
+	count := make(map[string]int)
+	swept := new(big.Int)
+	for _, item := range job.Items {
+		count[item.State]++
+		if item.Action == "swept" && (item.State == "broadcast" || item.State == "confirmed") {
+			if amount, err := ParseAmount(item.Amount); err == nil {
+				swept.Add(swept, amount)
+			}
+		}
+	}
+
+	return fmt.Sprintf("#%d\t%s\tby %s\t%s\t%d addresses: %d confirmed, %d broadcast, %d failed, %d skipped, %d unfinished\t%s swept",
+		job.ID, time.Unix(job.Created, 0).Format("2006-01-02 15:04:05"), job.Admin, job.Status(), len(job.Items),
+		count["confirmed"], count["broadcast"], count["failed"], count["skipped"], count["planned"]+count["signed"], swept)
+}
+
+func putJob(job *CentralizeJob) error {
+	job.Updated = time.Now().Unix()
+	err := store.Update(func(tx StorageTx) error {
+		return tx.Put(BucketCentralizeJobs, jobKey(job.ID), job)
+	})
+	if err != nil {
+		return errors.New("fail to save centralize job: " + err.Error())
+	}
+
+	return nil
+}
+
+func jobKey(id uint64) string {
+	return fmt.Sprintf("%016d", id)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Config : the settings of a deployment, read from the config file and overridden by the environment
+type Config struct {
+	// RPCAddress : the rpc address of the node
+	RPCAddress string `yaml:"rpcaddress"`
+	// DataDir : the directory holding the store, the legacy text files and exported batches
+	DataDir string `yaml:"datadir"`
+	// MainAddress : the hot wallet sending withdrawals and receiving centralized funds
+	MainAddress string `yaml:"mainaddress"`
+	// KeystoreDir : the keystore holding the keys of the hot wallet, the gas station and the legacy pool,
+	// only a watch-only machine, whose SeedSource is none, may leave it empty and sign nothing
+	KeystoreDir string `yaml:"keystoredir"`
+	// PasswordSource : where the keystore password comes from
+	//  prompt: ask on the console at startup
+	//  env:NAME: read the environment variable NAME
+	//  file:PATH: read the first line of the file PATH
+	PasswordSource string `yaml:"passwordsource"`
+	// SeedSource : where the master mnemonic deposit addresses are derived from comes from, as PasswordSource,
+	// or none on a watch-only machine that derives them from XPub and cannot sign for them
+	SeedSource string `yaml:"seedsource"`
+	// XPub : the extended public key at DepositXPubPath, required when SeedSource is none
+	XPub string `yaml:"xpub"`
+
+	// DepositConfirmations : the number of blocks on top of a deposit before it is credited
+	DepositConfirmations int `yaml:"depositconfirmations"`
+	// SettleConfirmations : the number of blocks on top of a transaction before it is settled
+	SettleConfirmations int `yaml:"settleconfirmations"`
+	// GasLimitMultiplier : the gas limit in percent of the node's estimate
+	GasLimitMultiplier int `yaml:"gaslimitmultiplier"`
+	// GasLimitCap : the highest gas limit of a transaction
+	GasLimitCap int `yaml:"gaslimitcap"`
+
+	// ApprovalThreshold : withdrawals above it in wei wait for approvals, empty sends every withdrawal right away
+	ApprovalThreshold string `yaml:"approvalthreshold"`
+	// RequiredApprovals : the number of different admins who approve a withdrawal above ApprovalThreshold
+	RequiredApprovals int `yaml:"requiredapprovals"`
+	// WhitelistCooldown : how long a newly whitelisted withdrawal address waits before it is usable, such as 24h
+	WhitelistCooldown string `yaml:"whitelistcooldown"`
+
+	// UserHourlyLimit : the amount in wei a user may withdraw in the last hour, empty for no limit
+	UserHourlyLimit string `yaml:"userhourlylimit"`
+	// UserDailyLimit : the amount in wei a user may withdraw in the last 24 hours, empty for no limit
+	UserDailyLimit string `yaml:"userdailylimit"`
+	// UserDailyCount : the number of withdrawals a user may make in the last 24 hours, 0 for no limit
+	UserDailyCount int `yaml:"userdailycount"`
+	// GlobalDailyLimit : the amount in wei the hot wallet may send in withdrawals in the last 24 hours, empty for no limit
+	GlobalDailyLimit string `yaml:"globaldailylimit"`
+
+	// ColdAddress : the watch-only cold wallet, whose key is only on the offline signer, empty keeps everything in the hot wallet
+	ColdAddress string `yaml:"coldaddress"`
+	// HotLowMark : with a cold wallet, the hot wallet is refilled from it below this amount in wei
+	HotLowMark string `yaml:"hotlowmark"`
+	// HotHighMark : with a cold wallet, the hot wallet is swept to it above this amount in wei
+	HotHighMark string `yaml:"hothighmark"`
+
+	// SweepMinimum : centralize skips addresses whose ether after gas is below this amount in wei
+	SweepMinimum string `yaml:"sweepminimum"`
+	// Tokens : the ERC-20 tokens centralize sweeps before the ether
+	Tokens []string `yaml:"tokens"`
+	// GasStation : the account sending the gas for token sweeps to addresses that lack it
+	GasStation string `yaml:"gasstation"`
+}
+
+// VelocityLimits : the withdrawal limits of the config, nil or zero for the ones that do not apply
+type VelocityLimits struct {
+	UserHourly     *big.Int
+	UserDaily      *big.Int
+	UserDailyCount int
+	GlobalDaily    *big.Int
+}
+
+// configenv : the environment variable overriding each setting
+var configenv = map[string]string{
+	"rpcaddress":     "MYETH_RPC_ADDRESS",
+	"datadir":        "MYETH_DATA_DIR",
+	"mainaddress":    "MYETH_MAIN_ADDRESS",
+	"keystoredir":    "MYETH_KEYSTORE_DIR",
+	"passwordsource": "MYETH_PASSWORD_SOURCE",
+	"seedsource":     "MYETH_SEED_SOURCE",
+	"xpub":           "MYETH_XPUB",
+
+	"depositconfirmations": "MYETH_DEPOSIT_CONFIRMATIONS",
+	"settleconfirmations":  "MYETH_SETTLE_CONFIRMATIONS",
+	"gaslimitmultiplier":   "MYETH_GAS_LIMIT_MULTIPLIER",
+	"gaslimitcap":          "MYETH_GAS_LIMIT_CAP",
+
+	"approvalthreshold": "MYETH_APPROVAL_THRESHOLD",
+	"requiredapprovals": "MYETH_REQUIRED_APPROVALS",
+	"whitelistcooldown": "MYETH_WHITELIST_COOLDOWN",
+
+	"userhourlylimit":  "MYETH_USER_HOURLY_LIMIT",
+	"userdailylimit":   "MYETH_USER_DAILY_LIMIT",
+	"userdailycount":   "MYETH_USER_DAILY_COUNT",
+	"globaldailylimit": "MYETH_GLOBAL_DAILY_LIMIT",
+
+	"coldaddress": "MYETH_COLD_ADDRESS",
+	"hotlowmark":  "MYETH_HOT_LOW_MARK",
+	"hothighmark": "MYETH_HOT_HIGH_MARK",
+
+	"sweepminimum": "MYETH_SWEEP_MINIMUM",
+	"tokens":       "MYETH_TOKENS",
+	"gasstation":   "MYETH_GAS_STATION",
+}
+
+// LoadConfig : returns the validated config from path and the environment,
+// a missing file leaves everything to the defaults and the environment
+func LoadConfig(path string) (*Config, error) {
+	config := Config{
+		RPCAddress:     "http://localhost:8545",
+		DataDir:        "SystemData",
+		PasswordSource: "prompt",
+		SeedSource:     "prompt",
+
+		DepositConfirmations: 6,
+		SettleConfirmations:  6,
+		GasLimitMultiplier:   120,
+		GasLimitCap:          500000,
+
+		RequiredApprovals: 1,
+		WhitelistCooldown: "24h",
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("fail to read config " + path + ": " + err.Error())
+	}
+	if err == nil {
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return nil, errors.New("fail to parse config " + path + ": " + err.Error())
+		}
+	}
+
+	for key, field := range map[string]*string{
+		"rpcaddress":     &config.RPCAddress,
+		"datadir":        &config.DataDir,
+		"mainaddress":    &config.MainAddress,
+		"keystoredir":    &config.KeystoreDir,
+		"passwordsource": &config.PasswordSource,
+		"seedsource":     &config.SeedSource,
+		"xpub":           &config.XPub,
+
+		"approvalthreshold": &config.ApprovalThreshold,
+		"whitelistcooldown": &config.WhitelistCooldown,
+
+		"userhourlylimit":  &config.UserHourlyLimit,
+		"userdailylimit":   &config.UserDailyLimit,
+		"globaldailylimit": &config.GlobalDailyLimit,
+
+		"coldaddress": &config.ColdAddress,
+		"hotlowmark":  &config.HotLowMark,
+		"hothighmark": &config.HotHighMark,
+
+		"sweepminimum": &config.SweepMinimum,
+		"gasstation":   &config.GasStation,
+	} {
+		if value, ok := os.LookupEnv(configenv[key]); ok {
+			*field = value
+		}
+	}
+	// a comma separated list
+	if value, ok := os.LookupEnv(configenv["tokens"]); ok {
+		config.Tokens = []string{}
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				config.Tokens = append(config.Tokens, token)
+			}
+		}
+	}
+	for key, field := range map[string]*int{
+		"depositconfirmations": &config.DepositConfirmations,
+		"settleconfirmations":  &config.SettleConfirmations,
+		"gaslimitmultiplier":   &config.GasLimitMultiplier,
+		"gaslimitcap":          &config.GasLimitCap,
+
+		"requiredapprovals": &config.RequiredApprovals,
+		"userdailycount":    &config.UserDailyCount,
+	} {
+		if value, ok := os.LookupEnv(configenv[key]); ok {
+			*field, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.New("invalid config: " + configenv[key] + " " + value + " is not a number")
+			}
+		}
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	config.MainAddress = strings.ToLower(config.MainAddress)
+	config.ColdAddress = strings.ToLower(config.ColdAddress)
+	config.GasStation = strings.ToLower(config.GasStation)
+	for i := range config.Tokens {
+		config.Tokens[i] = strings.ToLower(config.Tokens[i])
+	}
+	return &config, nil
+}
+
+// Validate : returns an error naming the first setting that is missing or wrong
+func (c *Config) Validate() error {
+	invalid := func(key, reason string) error {
+		return errors.New("invalid config: " + key + " " + reason + " (set it in the config file or " + configenv[key] + ")")
+	}
+
+	if c.RPCAddress == "" {
+		return invalid("rpcaddress", "is not set")
+	}
+
+	if c.DataDir == "" {
+		return invalid("datadir", "is not set")
+	}
+	if info, err := os.Stat(c.DataDir); err != nil || !info.IsDir() {
+		return invalid("datadir", c.DataDir+" is not a directory")
+	}
+
+	if c.MainAddress == "" {
+		return invalid("mainaddress", "is not set")
+	}
+	if !common.IsHexAddress(c.MainAddress) {
+		return invalid("mainaddress", c.MainAddress+" is not an address")
+	}
+
+	// a watch-only machine signs nothing, everything it sends goes through offline batches
+	if c.KeystoreDir == "" && c.SeedSource != "none" {
+		return invalid("keystoredir", "is not set, it is only optional when seedsource is none")
+	}
+	if c.KeystoreDir != "" {
+		if info, err := os.Stat(c.KeystoreDir); err != nil || !info.IsDir() {
+			return invalid("keystoredir", c.KeystoreDir+" is not a directory")
+		}
+	}
+
+	for key, source := range map[string]string{"passwordsource": c.PasswordSource, "seedsource": c.SeedSource} {
+		switch {
+		case source == "none" && key == "seedsource":
+			if c.XPub == "" {
+				return invalid("xpub", "is not set, it is required when seedsource is none")
+			}
+		case source == "prompt":
+		case strings.HasPrefix(source, "env:") && len(source) > len("env:"):
+		case strings.HasPrefix(source, "file:") && len(source) > len("file:"):
+		default:
+			return invalid(key, "must be prompt, env:NAME or file:PATH")
+		}
+	}
+
+	for key, depth := range map[string]int{"depositconfirmations": c.DepositConfirmations, "settleconfirmations": c.SettleConfirmations} {
+		if depth < 0 {
+			return invalid(key, "must not be negative")
+		}
+	}
+	if c.GasLimitMultiplier < 100 {
+		return invalid("gaslimitmultiplier", "must be at least 100 percent of the estimate")
+	}
+	if c.GasLimitCap < 21000 {
+		return invalid("gaslimitcap", "must be at least 21000, the gas of a plain transfer")
+	}
+
+	for key, amount := range map[string]string{
+		"approvalthreshold": c.ApprovalThreshold,
+		"userhourlylimit":   c.UserHourlyLimit,
+		"userdailylimit":    c.UserDailyLimit,
+		"globaldailylimit":  c.GlobalDailyLimit,
+		"hotlowmark":        c.HotLowMark,
+		"hothighmark":       c.HotHighMark,
+		"sweepminimum":      c.SweepMinimum,
+	} {
+		if _, err := parseSetting(amount); err != nil {
+			return invalid(key, amount+" is not an amount in wei")
+		}
+	}
+	if c.UserDailyCount < 0 {
+		return invalid("userdailycount", "must not be negative")
+	}
+
+	if c.ColdAddress != "" {
+		if !common.IsHexAddress(c.ColdAddress) {
+			return invalid("coldaddress", c.ColdAddress+" is not an address")
+		}
+		if strings.EqualFold(c.ColdAddress, c.MainAddress) {
+			return invalid("coldaddress", "must not be the hot wallet")
+		}
+		if c.HotLowMark == "" || c.HotHighMark == "" {
+			return invalid("hotlowmark", "and hothighmark are required with a cold wallet")
+		}
+		if _, _, err := c.Watermarks(); err != nil {
+			return invalid("hotlowmark", "must be below hothighmark")
+		}
+	}
+
+	for _, token := range c.Tokens {
+		if !common.IsHexAddress(token) {
+			return invalid("tokens", token+" is not an address")
+		}
+	}
+	if c.GasStation != "" {
+		if !common.IsHexAddress(c.GasStation) {
+			return invalid("gasstation", c.GasStation+" is not an address")
+		}
+		if strings.EqualFold(c.GasStation, c.MainAddress) || strings.EqualFold(c.GasStation, c.ColdAddress) {
+			return invalid("gasstation", "must not be the hot or the cold wallet")
+		}
+	}
+	if c.RequiredApprovals < 1 {
+		return invalid("requiredapprovals", "must be at least 1")
+	}
+	if cooldown, err := time.ParseDuration(c.WhitelistCooldown); err != nil || cooldown < 0 {
+		return invalid("whitelistcooldown", c.WhitelistCooldown+" is not a duration such as 24h")
+	}
+
+	return nil
+}
+
+// DataPath : returns the path of name in the data directory
+func (c *Config) DataPath(name string) string {
+	return filepath.Join(c.DataDir, name)
+}
+
+// Threshold : returns the amount above which withdrawals need approval, nil if they never do
+func (c *Config) Threshold() (*big.Int, error) {
+	return parseSetting(c.ApprovalThreshold)
+}
+
+// Limits : returns the withdrawal limits
+func (c *Config) Limits() (*VelocityLimits, error) {
+	var err error
+	limits := VelocityLimits{UserDailyCount: c.UserDailyCount}
+	for _, setting := range []struct {
+		amount string
+		field  **big.Int
+	}{
+		{c.UserHourlyLimit, &limits.UserHourly},
+		{c.UserDailyLimit, &limits.UserDaily},
+		{c.GlobalDailyLimit, &limits.GlobalDaily},
+	} {
+		*setting.field, err = parseSetting(setting.amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &limits, nil
+}
+
+// SweepThreshold : returns the least ether centralize sends from an address, nil if any amount is sent
+func (c *Config) SweepThreshold() (*big.Int, error) {
+	return parseSetting(c.SweepMinimum)
+}
+
+// Watermarks : returns the low and high marks of the hot wallet
+func (c *Config) Watermarks() (*big.Int, *big.Int, error) {
+	low, err := parseSetting(c.HotLowMark)
+	if err != nil {
+		return nil, nil, err
+	}
+	high, err := parseSetting(c.HotHighMark)
+	if err != nil {
+		return nil, nil, err
+	}
+	if low == nil || high == nil || low.Cmp(high) >= 0 {
+		return nil, nil, errors.New("the hot wallet needs a low mark below its high mark")
+	}
+
+	return low, high, nil
+}
+
+// parseSetting : returns an amount setting in wei, nil if it is empty
+func parseSetting(amount string) (*big.Int, error) {
+	if amount == "" {
+		return nil, nil
+	}
+
+	value, err := ParseAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	if value.Sign() < 0 {
+		return nil, errors.New("invalid amount: " + amount)
+	}
+
+	return value, nil
+}
+
+// Cooldown : returns how long a newly whitelisted withdrawal address waits before it is usable
+func (c *Config) Cooldown() time.Duration {
+	cooldown, _ := time.ParseDuration(c.WhitelistCooldown)
+	return cooldown
+}
+
+// KeystorePassword : returns the password unlocking the keystore from the password source
+func (c *Config) KeystorePassword() (string, error) {
+	if c.KeystoreDir == "" {
+		return "", nil
+	}
+
+	return readSecret(c.PasswordSource, "keystore password")
+}
+
+// MasterSeed : returns the master mnemonic from the seed source, empty if the source is none
+func (c *Config) MasterSeed() (string, error) {
+	if c.SeedSource == "none" {
+		return "", nil
+	}
+
+	return readSecret(c.SeedSource, "master seed")
+}
+
+// readSecret : returns the secret named what from source
+func readSecret(source, what string) (string, error) {
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New(what + " variable " + name + " is not set")
+		}
+		return secret, nil
+	case strings.HasPrefix(source, "file:"):
+		path := strings.TrimPrefix(source, "file:")
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.New("fail to read " + what + ": " + err.Error())
+		}
+		return strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r"), nil
+	default:
+		fmt.Println("please input the " + what + ":")
+		secret, _, err := bufio.NewReader(os.Stdin).ReadLine()
+		if err != nil {
+			return "", errors.New("fail to read " + what + ": " + err.Error())
+		}
+		return string(secret), nil
+	}
+}
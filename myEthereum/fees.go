@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// FeeParams : the fee fields of a transaction
+// GasPrice is set for legacy transactions, GasFeeCap and GasTipCap for dynamic-fee transactions
+type FeeParams struct {
+	GasPrice  *big.Int
+	GasFeeCap *big.Int
+	GasTipCap *big.Int
+}
+
+// IsDynamic : returns true if the fees are for a dynamic-fee transaction
+func (f *FeeParams) IsDynamic() bool {
+	return f.GasFeeCap != nil
+}
+
+// SuggestFees : returns dynamic fees derived from the fee history if the chain follows
+// London rules, or a legacy gas price if the genesis has no London block
+func SuggestFees(client *ethclient.Client) (*FeeParams, error) {
+	header, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.BaseFee == nil {
+		gasPrice, err := client.SuggestGasPrice(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		return &FeeParams{GasPrice: gasPrice.Add(gasPrice, big.NewInt(GasPriceDelta))}, nil
+	}
+
+	history, err := client.FeeHistory(context.Background(), FeeHistoryBlocks, nil, []float64{FeeHistoryPercentile})
+	if err != nil {
+		return nil, err
+	}
+
+	// the tip is the median of the recent blocks' rewards at the chosen percentile
+	rewards := []*big.Int{}
+	for _, reward := range history.Reward {
+		if len(reward) > 0 && reward[0] != nil {
+			rewards = append(rewards, reward[0])
+		}
+	}
+
+	var tip *big.Int
+	if len(rewards) > 0 {
+		sort.Slice(rewards, func(i, j int) bool { return rewards[i].Cmp(rewards[j]) < 0 })
+		tip = new(big.Int).Set(rewards[len(rewards)/2])
+	}
+	if tip == nil || tip.Sign() == 0 {
+		tip, err = client.SuggestGasTipCap(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the last base fee in the history is the one of the next block, leave room for it to double
+	baseFee := header.BaseFee
+	if len(history.BaseFee) > 0 {
+		baseFee = history.BaseFee[len(history.BaseFee)-1]
+	}
+
+	feeCap := new(big.Int).Mul(baseFee, big.NewInt(2))
+	feeCap.Add(feeCap, tip)
+
+	return &FeeParams{GasFeeCap: feeCap, GasTipCap: tip}, nil
+}
+
+// EstimateMaxFee : returns the most a transaction from from to to can pay in fees
+func EstimateMaxFee(client *ethclient.Client, from, to string, value *big.Int) (*big.Int, error) {
+	gasLimit, _, err := EstimateGasLimit(client, from, common.HexToAddress(to), value, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fees, err := SuggestFees(client)
+	if err != nil {
+		return nil, err
+	}
+
+	price := fees.GasPrice
+	if fees.IsDynamic() {
+		price = fees.GasFeeCap
+	}
+
+	return new(big.Int).Mul(price, new(big.Int).SetUint64(gasLimit)), nil
+}
+
+// BumpFees : returns the fees of a replacement for tx, ReplaceBumpPercent above the
+// replaced fees and no lower than the suggested ones
+func BumpFees(tx *MyTransaction, suggested *FeeParams) (*FeeParams, error) {
+	bump := func(amount string) (*big.Int, error) {
+		value, err := ParseAmount(amount)
+		if err != nil {
+			return nil, err
+		}
+		value.Mul(value, big.NewInt(ReplaceBumpPercent))
+		return value.Div(value, big.NewInt(100)), nil
+	}
+	atLeast := func(a, b *big.Int) *big.Int {
+		if a.Cmp(b) < 0 {
+			return b
+		}
+		return a
+	}
+
+	// a legacy transaction pays its gas price both as fee cap and tip
+	oldFeeCap, oldTipCap := tx.GasFeeCap, tx.GasTipCap
+	if oldFeeCap == "" {
+		oldFeeCap, oldTipCap = tx.GasPrice, tx.GasPrice
+	}
+
+	// the cap holds for what is finally paid, the node's suggestion included
+	capped := func(fee *big.Int) error {
+		if fee.Cmp(big.NewInt(MaxGasPrice)) > 0 {
+			return errors.New("replacement gas price would exceed MaxGasPrice")
+		}
+		return nil
+	}
+
+	feeCap, err := bump(oldFeeCap)
+	if err != nil {
+		return nil, errors.New("fail to get gas price: " + err.Error())
+	}
+
+	if !suggested.IsDynamic() {
+		fees := &FeeParams{GasPrice: atLeast(feeCap, suggested.GasPrice)}
+		if err := capped(fees.GasPrice); err != nil {
+			return nil, err
+		}
+		return fees, nil
+	}
+
+	tip, err := bump(oldTipCap)
+	if err != nil {
+		return nil, errors.New("fail to get gas price: " + err.Error())
+	}
+
+	fees := &FeeParams{GasFeeCap: atLeast(feeCap, suggested.GasFeeCap), GasTipCap: atLeast(tip, suggested.GasTipCap)}
+	fees.GasFeeCap = atLeast(fees.GasFeeCap, fees.GasTipCap)
+	if err := capped(fees.GasFeeCap); err != nil {
+		return nil, err
+	}
+	return fees, nil
+}
+
+// NewFeeTransaction : returns an unsigned dynamic-fee or legacy transaction depending on fees
+func NewFeeTransaction(chainID *big.Int, nonce uint64, to common.Address, value *big.Int, gasLimit uint64, fees *FeeParams, data []byte) *types.Transaction {
+	if !fees.IsDynamic() {
+		return types.NewTransaction(nonce, to, value, gasLimit, fees.GasPrice, data)
+	}
+
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: fees.GasTipCap,
+		GasFeeCap: fees.GasFeeCap,
+		Gas:       gasLimit,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+	"github.com/tyler-smith/go-bip32"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// User : a user registered by name, whose deposit address is derived from the master seed at Index
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordhash"`
+	Address      string `json:"address"`
+	Index        uint64 `json:"index"`
+}
+
+// DepositXPubPath : the derivation path of the extended public key deposit addresses are derived from
+const DepositXPubPath = "m/44'/60'/0'/0"
+
+// DepositPath : returns the derivation path of the deposit address at index
+func DepositPath(index uint64) string {
+	return fmt.Sprintf("m/44'/60'/0'/0/%d", index)
+}
+
+// OpenMasterWallet : returns the platform wallet of a master mnemonic
+func OpenMasterWallet(mnemonic string) (*hdwallet.Wallet, error) {
+	if !bip39.IsMnemonicValid(mnemonic) {
+		return nil, errors.New("the master seed is not a valid mnemonic")
+	}
+
+	wallet, err := hdwallet.NewFromMnemonic(mnemonic)
+	if err != nil {
+		return nil, errors.New("fail to open master wallet: " + err.Error())
+	}
+
+	return wallet, nil
+}
+
+// ExportXPub : returns the extended public key at DepositXPubPath of a master mnemonic
+func ExportXPub(mnemonic string) (string, error) {
+	if !bip39.IsMnemonicValid(mnemonic) {
+		return "", errors.New("the master seed is not a valid mnemonic")
+	}
+
+	key, err := bip32.NewMasterKey(bip39.NewSeed(mnemonic, ""))
+	if err != nil {
+		return "", errors.New("fail to export xpub: " + err.Error())
+	}
+
+	// m/44'/60'/0'/0
+	for _, child := range []uint32{bip32.FirstHardenedChild + 44, bip32.FirstHardenedChild + 60, bip32.FirstHardenedChild, 0} {
+		key, err = key.NewChildKey(child)
+		if err != nil {
+			return "", errors.New("fail to export xpub: " + err.Error())
+		}
+	}
+
+	return key.PublicKey().B58Serialize(), nil
+}
+
+// ParseXPub : returns the extended public key deposit addresses are derived from
+func ParseXPub(xpub string) (*bip32.Key, error) {
+	key, err := bip32.B58Deserialize(xpub)
+	if err != nil {
+		return nil, errors.New("fail to parse xpub: " + err.Error())
+	}
+	if key.IsPrivate {
+		return nil, errors.New("the xpub is an extended private key, configure the public key only")
+	}
+
+	return key, nil
+}
+
+// DeriveAddress : returns the deposit address at index, derived from the xpub alone
+func DeriveAddress(index uint64) (string, error) {
+	if index >= uint64(bip32.FirstHardenedChild) {
+		return "", errors.New("fail to derive address: index " + fmt.Sprint(index) + " is out of range")
+	}
+
+	child, err := depositxpub.NewChildKey(uint32(index))
+	if err != nil {
+		return "", errors.New("fail to derive address: " + err.Error())
+	}
+
+	publicKey, err := crypto.DecompressPubkey(child.Key)
+	if err != nil {
+		return "", errors.New("fail to derive address: " + err.Error())
+	}
+
+	return strings.ToLower(crypto.PubkeyToAddress(*publicKey).Hex()), nil
+}
+
+// CheckXPub : returns an error unless the xpub belongs to the master seed, if this machine holds it
+func CheckXPub() error {
+	if master == nil {
+		return nil
+	}
+
+	address, err := DeriveAddress(0)
+	if err != nil {
+		return err
+	}
+
+	account, err := master.Derive(hdwallet.MustParseDerivationPath(DepositPath(0)), false)
+	if err != nil {
+		return errors.New("fail to derive address: " + err.Error())
+	}
+
+	if !strings.EqualFold(address, account.Address.Hex()) {
+		return errors.New("the xpub does not belong to the master seed")
+	}
+
+	return nil
+}
+
+// DeriveKey : returns the private key of the deposit address at index,
+// only the signer holding the master seed can
+func DeriveKey(index uint64) (*ecdsa.PrivateKey, error) {
+	if master == nil {
+		return nil, errors.New("this machine holds no master seed, sign on the machine that does")
+	}
+
+	account, err := master.Derive(hdwallet.MustParseDerivationPath(DepositPath(index)), false)
+	if err != nil {
+		return nil, errors.New("fail to derive key: " + err.Error())
+	}
+
+	return master.PrivateKey(account)
+}
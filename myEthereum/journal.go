@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Posting : an amount posted to a ledger account, debits are positive and credits negative
+type Posting struct {
+	Account string `json:"account"`
+	Amount  string `json:"amount"`
+}
+
+// JournalEntry : a balanced set of postings, entries are only ever appended
+// entry kind
+//  opening: balances carried over from before the journal
+//  recharge, withdraw, centralize, sweep, refill, gasfunding: a settled transaction, including its fee
+//  reversal: takes back a transaction whose block was reorganized away
+type JournalEntry struct {
+	ID       uint64    `json:"id"`
+	Time     int64     `json:"time"`
+	Kind     string    `json:"kind"`
+	Ref      string    `json:"ref"`
+	Postings []Posting `json:"postings"`
+}
+
+const (
+	// FeeAccount : the expense account of gas the platform pays
+	FeeAccount = "expense:fee"
+	// OpeningAccount : the equity account balancing opening entries
+	OpeningAccount = "equity:opening"
+)
+
+// UserAccount : returns the liability account of what the platform owes a user
+func UserAccount(address string) string {
+	return "liability:user:" + strings.ToLower(address)
+}
+
+// DepositAccount : returns the asset account of what a user's deposit address holds
+func DepositAccount(address string) string {
+	return "asset:deposit:" + strings.ToLower(address)
+}
+
+// HotAccount : returns the asset account of what the hot wallet holds
+func HotAccount() string {
+	return "asset:hot:" + strings.ToLower(config.MainAddress)
+}
+
+// ColdAccount : returns the asset account of what the cold wallet holds
+func ColdAccount() string {
+	return "asset:cold:" + strings.ToLower(config.ColdAddress)
+}
+
+// GasStationAccount : returns the asset account of what the gas station holds
+func GasStationAccount() string {
+	return "asset:gasstation:" + strings.ToLower(config.GasStation)
+}
+
+// TransactionPostings : returns the postings of a settled transaction of address
+// a failed transaction moves no value but still pays its fee, the platform pays
+// the fee of a withdrawal unless WithdrawFeePolicy is "user"
+func TransactionPostings(address string, tx *MyTransaction) ([]Posting, error) {
+	amount, err := ParseAmount(tx.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Status == "2" {
+		amount = new(big.Int)
+	}
+
+	fee := new(big.Int)
+	if tx.Fee != "" {
+		fee, err = ParseAmount(tx.Fee)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	postings := []Posting{}
+	post := func(debit, credit string, value *big.Int) {
+		if value.Sign() == 0 {
+			return
+		}
+		postings = append(postings,
+			Posting{Account: debit, Amount: value.String()},
+			Posting{Account: credit, Amount: new(big.Int).Neg(value).String()})
+	}
+
+	switch tx.Type {
+	case "0":
+		post(DepositAccount(address), UserAccount(address), amount)
+	case "1":
+		post(UserAccount(address), HotAccount(), amount)
+		if WithdrawFeePolicy == "user" {
+			post(UserAccount(address), HotAccount(), fee)
+		} else {
+			post(FeeAccount, HotAccount(), fee)
+		}
+	case "2":
+		post(HotAccount(), DepositAccount(address), amount)
+		post(FeeAccount, DepositAccount(address), fee)
+	case "3":
+		post(ColdAccount(), HotAccount(), amount)
+		post(FeeAccount, HotAccount(), fee)
+	case "4":
+		post(HotAccount(), ColdAccount(), amount)
+		post(FeeAccount, ColdAccount(), fee)
+	case "5":
+		post(DepositAccount(address), GasStationAccount(), amount)
+		post(FeeAccount, GasStationAccount(), fee)
+	default:
+		return nil, errors.New("unknown transaction type " + tx.Type)
+	}
+
+	return postings, nil
+}
+
+// PostTransaction : append the journal entry of a settled transaction of address,
+// or its reversal if revert is set
+func PostTransaction(stx StorageTx, address string, tx *MyTransaction, revert bool) error {
+	postings, err := TransactionPostings(address, tx)
+	if err != nil {
+		return err
+	}
+
+	kind := map[string]string{"0": "recharge", "1": "withdraw", "2": "centralize", "3": "sweep", "4": "refill", "5": "gasfunding"}[tx.Type]
+	if revert {
+		kind = "reversal"
+		for i := range postings {
+			amount, _ := ParseAmount(postings[i].Amount)
+			postings[i].Amount = amount.Neg(amount).String()
+		}
+	}
+
+	return PostEntry(stx, &JournalEntry{Kind: kind, Ref: tx.Hash, Postings: postings})
+}
+
+// PostEntry : append an entry to the journal, it must be balanced
+func PostEntry(stx StorageTx, entry *JournalEntry) error {
+	sum := new(big.Int)
+	for _, posting := range entry.Postings {
+		amount, err := ParseAmount(posting.Amount)
+		if err != nil {
+			return err
+		}
+		sum.Add(sum, amount)
+	}
+	if sum.Sign() != 0 {
+		return errors.New("unbalanced journal entry for " + entry.Ref)
+	}
+
+	id, err := stx.NextID(BucketJournal)
+	if err != nil {
+		return err
+	}
+
+	entry.ID = id
+	entry.Time = time.Now().Unix()
+	err = stx.Put(BucketJournal, fmt.Sprintf("%016d", id), entry)
+	if err != nil {
+		return err
+	}
+
+	return indexJournal(stx, id)
+}
+
+// IndexJournal : apply the journal entries posted before the running balances existed, once
+func IndexJournal() error {
+	err := store.Update(func(stx StorageTx) error {
+		keys, err := stx.Keys(BucketJournal)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+
+		var last JournalEntry
+		if _, err := stx.Get(BucketJournal, keys[len(keys)-1], &last); err != nil {
+			return err
+		}
+
+		return indexJournal(stx, last.ID)
+	})
+	if err != nil {
+		return errors.New("fail to index journal: " + err.Error())
+	}
+
+	return nil
+}
+
+// indexJournal : add the postings of the entries after the index up to id to the running balances
+func indexJournal(stx StorageTx, id uint64) error {
+	var index uint64
+	if _, err := stx.Get(BucketMeta, MetaJournalIndex, &index); err != nil {
+		return err
+	}
+	if id <= index {
+		return nil
+	}
+
+	for next := index + 1; next <= id; next++ {
+		var entry JournalEntry
+		found, err := stx.Get(BucketJournal, fmt.Sprintf("%016d", next), &entry)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		for _, posting := range entry.Postings {
+			amount, err := ParseAmount(posting.Amount)
+			if err != nil {
+				return err
+			}
+
+			balance, err := AccountBalance(stx, posting.Account)
+			if err != nil {
+				return err
+			}
+			err = stx.Put(BucketBalances, posting.Account, balance.Add(balance, amount).String())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return stx.Put(BucketMeta, MetaJournalIndex, id)
+}
+
+// AccountBalance : returns the running balance of a ledger account, debits are positive
+func AccountBalance(stx StorageTx, account string) (*big.Int, error) {
+	var balance string
+	found, err := stx.Get(BucketBalances, account, &balance)
+	if err != nil || !found {
+		return new(big.Int), err
+	}
+
+	return ParseAmount(balance)
+}
+
+// OpenJournal : post the balances a ledger had before the journal existed, once
+func OpenJournal(stx StorageTx, address string, info *AccountInfo) error {
+	if info.Journaled {
+		return nil
+	}
+
+	balance, err := ParseAmount(info.Balance)
+	if err != nil {
+		return err
+	}
+	addrbalance, err := ParseAmount(info.AddrBalance)
+	if err != nil {
+		return err
+	}
+
+	opening := new(big.Int).Sub(balance, addrbalance)
+	postings := []Posting{}
+	for _, posting := range []Posting{
+		{Account: DepositAccount(address), Amount: addrbalance.String()},
+		{Account: UserAccount(address), Amount: new(big.Int).Neg(balance).String()},
+		{Account: OpeningAccount, Amount: opening.String()},
+	} {
+		if posting.Amount != "0" {
+			postings = append(postings, posting)
+		}
+	}
+
+	if len(postings) > 0 {
+		err = PostEntry(stx, &JournalEntry{Kind: "opening", Ref: strings.ToLower(address), Postings: postings})
+		if err != nil {
+			return err
+		}
+	}
+
+	info.Journaled = true
+	return nil
+}
+
+// JournalBalances : returns a user's balance and addrbalance from the running balances of the journal
+func JournalBalances(stx StorageTx, address string) (*big.Int, *big.Int, error) {
+	balance, err := AccountBalance(stx, UserAccount(address))
+	if err != nil {
+		return nil, nil, err
+	}
+	addrbalance, err := AccountBalance(stx, DepositAccount(address))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the user's balance is a liability, it grows with credits
+	return balance.Neg(balance), addrbalance, nil
+}
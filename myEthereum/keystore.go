@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// OpenKeystore : returns the keystore of dir, indexing every key file in it by address
+// key files added to dir later are picked up while the system runs
+func OpenKeystore(dir string) *keystore.KeyStore {
+	return keystore.NewKeyStore(dir, keystore.StandardScryptN, keystore.StandardScryptP)
+}
+
+// HasKey : returns whether the keystore holds the key of address
+func HasKey(address string) bool {
+	return keys != nil && keys.HasAddress(common.HexToAddress(address))
+}
+
+// CheckKeys : returns an error listing the hot wallet and legacy pool addresses without a key in the keystore,
+// and an error if the keystore password does not unlock the hot wallet
+func CheckKeys() error {
+	addresses := []string{config.MainAddress}
+	if config.GasStation != "" {
+		addresses = append(addresses, config.GasStation)
+	}
+	err := store.View(func(tx StorageTx) error {
+		accounts, err := GetPoolAccounts(tx)
+		if err != nil {
+			return err
+		}
+
+		// derived addresses get their keys from the master seed
+		for _, account := range accounts {
+			if !account.Derived {
+				addresses = append(addresses, account.Address)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.New("fail to open account pool: " + err.Error())
+	}
+
+	missing := []string{}
+	for _, address := range addresses {
+		if !keys.HasAddress(common.HexToAddress(address)) {
+			missing = append(missing, strings.ToLower(address))
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New("no key in keystore " + config.KeystoreDir + " for " + strings.Join(missing, ", ") +
+			": copy their key files into it, or import them with geth account import --keystore " + config.KeystoreDir)
+	}
+
+	// the hot wallet signs every withdrawal
+	_, err = LoadPrivateKey(config.MainAddress)
+	if err != nil {
+		return errors.New("fail to unlock the hot wallet, check the keystore password: " + err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// PoolAccount : an account in the account pool
+// an account is either from the legacy pool, with a mnemonic and a key file,
+// or derived from the master seed at Index
+// account status
+//  -1: reserved for the system
+//   0: available
+//   1: assigned to a user
+type PoolAccount struct {
+	Address  string `json:"address"`
+	Mnemonic string `json:"mnemonic,omitempty"`
+	Status   string `json:"status"`
+	Derived  bool   `json:"derived,omitempty"`
+	Index    uint64 `json:"index,omitempty"`
+}
+
+// AccountInfo : the ledger of a user
+// the balances are derived from the journal, journaled is set once the
+// balances from before the journal have been posted to it
+type AccountInfo struct {
+	Balance        string          `json:"balance"`
+	AddrBalance    string          `json:"addrbalance"`
+	PendingBalance string          `json:"pendingbalance"`
+	Transactions   []MyTransaction `json:"transactions"`
+	Journaled      bool            `json:"journaled,omitempty"`
+}
+
+// GetPoolAccounts : returns all the accounts in the account pool
+func GetPoolAccounts(tx StorageTx) ([]PoolAccount, error) {
+	keys, err := tx.Keys(BucketAccounts)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []PoolAccount{}
+	for _, key := range keys {
+		var account PoolAccount
+		if _, err := tx.Get(BucketAccounts, key, &account); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+// GetPoolAccount : returns the pool account of address, nil if there is none
+func GetPoolAccount(tx StorageTx, address string) (*PoolAccount, error) {
+	var account PoolAccount
+	found, err := tx.Get(BucketAccounts, strings.ToLower(address), &account)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// PutPoolAccount : add or update an account in the account pool
+func PutPoolAccount(tx StorageTx, account *PoolAccount) error {
+	return tx.Put(BucketAccounts, strings.ToLower(account.Address), account)
+}
+
+// GetAccountInfo : returns the ledger of address, an empty ledger if there is none yet
+func GetAccountInfo(tx StorageTx, address string) (*AccountInfo, error) {
+	info := AccountInfo{Balance: "0", AddrBalance: "0", PendingBalance: "0", Transactions: []MyTransaction{}}
+	if _, err := tx.Get(BucketAccountInfo, strings.ToLower(address), &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// PutAccountInfo : save the ledger of address
+func PutAccountInfo(tx StorageTx, address string, info *AccountInfo) error {
+	return tx.Put(BucketAccountInfo, strings.ToLower(address), info)
+}
+
+// ParseAmount : returns a decimal amount as big.Int
+func ParseAmount(amount string) (*big.Int, error) {
+	value, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		return nil, errors.New("invalid amount: " + amount)
+	}
+
+	return value, nil
+}
+
+// ReservedAmount : returns the amount a pending withdrawal keeps from the user's balance,
+// including the most it can pay in fees if the user pays them
+func ReservedAmount(tx *MyTransaction) (*big.Int, error) {
+	amount, err := ParseAmount(tx.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if WithdrawFeePolicy != "user" {
+		return amount, nil
+	}
+
+	price := tx.GasFeeCap
+	if price == "" {
+		price = tx.GasPrice
+	}
+	if price == "" {
+		return amount, nil
+	}
+
+	maxprice, err := ParseAmount(price)
+	if err != nil {
+		return nil, err
+	}
+
+	maxfee := new(big.Int).Mul(maxprice, new(big.Int).SetUint64(tx.Gas))
+	return amount.Add(amount, maxfee), nil
+}
+
+// ReservedBalance : returns the amount pending withdrawals keep from the user's balance,
+// each nonce reserving the largest amount of its replacement chain
+func ReservedBalance(info *AccountInfo) (*big.Int, error) {
+	pendingwithdraws := make(map[string]*big.Int)
+	for i := range info.Transactions {
+		tx := &info.Transactions[i]
+		if tx.Status != "0" || tx.Type != "1" {
+			continue
+		}
+
+		amount, err := ReservedAmount(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		key := NonceKey(tx)
+		if reserved, ok := pendingwithdraws[key]; !ok || reserved.Cmp(amount) < 0 {
+			pendingwithdraws[key] = amount
+		}
+	}
+
+	reserved := new(big.Int)
+	for _, amount := range pendingwithdraws {
+		reserved.Add(reserved, amount)
+	}
+
+	return reserved, nil
+}
+
+// syncLedger : save the ledger of address with its balances derived again, after a reservation changed
+func syncLedger(stx StorageTx, address string) error {
+	info, err := GetAccountInfo(stx, address)
+	if err != nil {
+		return err
+	}
+
+	err = SyncBalances(stx, address, info)
+	if err != nil {
+		return err
+	}
+
+	return PutAccountInfo(stx, address, info)
+}
+
+// SyncBalances : derive balance, addrbalance and pendingbalance of a ledger from the journal
+func SyncBalances(stx StorageTx, address string, info *AccountInfo) error {
+	balance, addrbalance, err := JournalBalances(stx, address)
+	if err != nil {
+		return err
+	}
+
+	reserved, err := ReservedBalance(info)
+	if err != nil {
+		return err
+	}
+
+	// withdraw requests whose withdrawal is not sent yet are not available either
+	requested, err := RequestedBalance(stx, address)
+	if err != nil {
+		return err
+	}
+	reserved.Add(reserved, requested)
+
+	// nor are withdrawals exported for offline signing
+	exported, err := ExportedBalance(stx, address)
+	if err != nil {
+		return err
+	}
+	reserved.Add(reserved, exported)
+
+	info.Balance = balance.String()
+	info.AddrBalance = addrbalance.String()
+	info.PendingBalance = new(big.Int).Sub(balance, reserved).String()
+	return nil
+}
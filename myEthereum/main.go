@@ -1,114 +1,397 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"strings"
 
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/ethclient"
+	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+	"github.com/tyler-smith/go-bip32"
 )
 
-var curuser string
-var keystoremap map[string]string
+var config *Config
+var keystorepassword string
+var keys *keystore.KeyStore
+var master *hdwallet.Wallet
+var depositxpub *bip32.Key
+var store Storage
 
 func main() {
-	keystoremap = make(map[string]string)
-	keystoremap["0xc0093215bec3cbb9522352dcb4e3fa8fd5b665d1"] = `D:\Projects\GethProgram\chain_10\keystore\UTC--2020-07-30T12-08-00.423453600Z--c0093215bec3cbb9522352dcb4e3fa8fd5b665d1`
-	keystoremap["0x8bf8fb9cfd048de2645539f5007d12ae6465623b"] = `D:\Projects\GethProgram\chain_10\keystore\UTC--2020-07-31T01-19-22.030531400Z--8bf8fb9cfd048de2645539f5007d12ae6465623b`
-	keystoremap["0x297fca8450553a3c9103dd410b59e79cdf6f4a0a"] = `D:\Projects\GethProgram\chain_10\keystore\UTC--2020-07-31T01-19-25.477316000Z--297fca8450553a3c9103dd410b59e79cdf6f4a0a`
-	keystoremap["0x85bdd4c54fc8689e2973ab8ded1cf46c55243e05"] = `D:\Projects\GethProgram\chain_10\keystore\UTC--2020-07-31T01-19-28.576035000Z--85bdd4c54fc8689e2973ab8ded1cf46c55243e05`
-	keystoremap["0x7e5befa8b17710f881f9011425a93e47dfa8590e"] = `D:\Projects\GethProgram\chain_10\keystore\UTC--2020-07-31T01-19-32.013843100Z--7e5befa8b17710f881f9011425a93e47dfa8590e`
-	keystoremap["0xf81233b607aa4178ed9e9e1e1a876b683619ef47"] = `D:\Projects\GethProgram\chain_10\keystore\UTC--2020-07-31T01-19-35.118545500Z--f81233b607aa4178ed9e9e1e1a876b683619ef47`
+	migrate := flag.Bool("migrate", false, "import the legacy text account pool and ledgers into the store, then exit")
+	httpaddr := flag.String("http", "", "serve the HTTP/JSON API on this address, e.g. :8080, instead of the menu")
+	configpath := flag.String("config", ConfigPath, "the config file, settings can be overridden by MYETH_* environment variables")
+	exportxpub := flag.Bool("exportxpub", false, "print the xpub of the master seed for watch-only machines, then exit")
+	sign := flag.String("sign", "", "sign an exported batch file on the offline machine, writing <file>.signed.json, then exit")
+	createadmin := flag.Bool("createadmin", false, "create the superadmin of a system without admins, reading the name and password from stdin, then exit")
+	flag.Parse()
 
-	var option int
-	islogin := false
-	isadmin := false
+	var err error
+	config, err = LoadConfig(*configpath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	for !islogin {
-		fmt.Println("please choose your option:")
-		fmt.Println("0: log in\t1: register\t2: log in as admin\t3: exit")
+	if *exportxpub {
+		seed, err := config.MasterSeed()
+		if err == nil && seed == "" {
+			err = errors.New("seedsource is none, export the xpub on the machine holding the master seed")
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 
-		_, err := fmt.Scanln(&option)
+		xpub, err := ExportXPub(seed)
 		if err != nil {
-			fmt.Println("invalid input")
-			continue
-		}
-
-		switch option {
-		case 0:
-			islogin = Login()
-			fmt.Println("")
-		case 1:
-			Register()
-			fmt.Println("")
-		case 2:
-			if LoginAsAdmin() {
-				islogin = true
-				isadmin = true
-			}
-			fmt.Println("")
-		case 3:
-			fmt.Println("")
+			fmt.Println(err)
+			return
+		}
+
+		fmt.Println(xpub)
+		return
+	}
+
+	if *sign != "" {
+		path, err := SignBatchFile(*sign)
+		if err != nil {
+			fmt.Println(err)
 			return
-		default:
-			fmt.Println("invalid input")
-			fmt.Println("")
 		}
+
+		fmt.Println("signed batch written to " + path)
+		return
+	}
+
+	store, err = OpenBoltStorage(config.DataPath(StorageFile))
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
 
-	client, err := ethclient.Dial(RPCAddress)
+	defer store.Close()
+
+	// journals written before the running balances are indexed once
+	err = IndexJournal()
 	if err != nil {
-		fmt.Println("connect failededed: ", err)
+		fmt.Println(err)
 		return
 	}
 
-	for !isadmin {
-		fmt.Println("please choose your option:")
-		fmt.Println("0: check balance\t1: recharge\t2: withdraw\t3: exit")
+	if *createadmin {
+		var name, password string
+		fmt.Println("please input the superadmin name:")
+		fmt.Scanln(&name)
+		fmt.Println("please input the password (at least 8 characters):")
+		fmt.Scanln(&password)
 
-		_, err := fmt.Scanln(&option)
+		err = CreateFirstAdmin(name, password)
 		if err != nil {
-			fmt.Println("invalid input")
-			continue
-		}
-
-		switch option {
-		case 0:
-			CheckBalance(client)
-			fmt.Println("")
-		case 1:
-			Recharge(client)
-			fmt.Println("")
-		case 2:
-			Withdraw(client)
-			fmt.Println("")
-		case 3:
-			fmt.Println("")
+			fmt.Println("failed to create admin: ", err)
 			return
-		default:
-			fmt.Println("invalid input")
-			fmt.Println("")
 		}
+
+		fmt.Println("superadmin " + name + " created")
+		return
 	}
 
-	for isadmin {
-		fmt.Println("please choose your option:")
-		fmt.Println("0: centralize\t1: exit")
+	if *migrate {
+		accounts, infos, err := MigrateTextLedger(config.DataPath(AcountPoolFile), config.DataPath(AccountInfoDir))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 
-		_, err := fmt.Scanln(&option)
+		fmt.Printf("imported %d accounts and %d ledgers\n", accounts, infos)
+		return
+	}
+
+	keystorepassword, err = config.KeystorePassword()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	seed, err := config.MasterSeed()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// deposit addresses come from the xpub, the seed is only needed to sign for them
+	xpub := config.XPub
+	if seed != "" {
+		master, err = OpenMasterWallet(seed)
 		if err != nil {
-			fmt.Println("invalid input")
-			continue
+			fmt.Println(err)
+			return
 		}
 
-		switch option {
-		case 0:
-			Centralize(client)
-			fmt.Println("")
-		case 1:
-			fmt.Println("")
+		if xpub == "" {
+			xpub, err = ExportXPub(seed)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+	}
+
+	depositxpub, err = ParseXPub(xpub)
+	if err == nil {
+		err = CheckXPub()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// every address the system signs for needs its key before anything is sent,
+	// a watch-only machine without a keystore sends through offline batches only
+	if config.KeystoreDir != "" {
+		keys = OpenKeystore(config.KeystoreDir)
+		err = CheckKeys()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	if *httpaddr != "" {
+		client, err := startClient()
+		if err != nil {
+			fmt.Println(err)
 			return
-		default:
-			fmt.Println("invalid input")
-			fmt.Println("")
+		}
+
+		fmt.Println("serving on " + *httpaddr)
+		err = NewServer(client).ListenAndServe(*httpaddr)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	var option int
+	var session *Session
+	var client *ethclient.Client
+
+	for {
+		for session == nil {
+			fmt.Println("please choose your option:")
+			fmt.Println("0: log in\t1: register\t2: log in as admin\t3: exit")
+
+			_, err := fmt.Scanln(&option)
+			if err != nil {
+				fmt.Println("invalid input")
+				continue
+			}
+
+			switch option {
+			case 0:
+				session = Login()
+				fmt.Println("")
+			case 1:
+				Register()
+				fmt.Println("")
+			case 2:
+				session = LoginAsAdmin()
+				fmt.Println("")
+			case 3:
+				fmt.Println("")
+				return
+			default:
+				fmt.Println("invalid input")
+				fmt.Println("")
+			}
+		}
+
+		if client == nil {
+			client, err = startClient()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+
+		for session != nil && session.Role == "user" {
+			fmt.Println("please choose your option:")
+			fmt.Println("0: check balance\t1: recharge\t2: withdraw\t3: withdrawal addresses\t4: log out\t5: exit")
+
+			_, err := fmt.Scanln(&option)
+			if err != nil {
+				fmt.Println("invalid input")
+				continue
+			}
+
+			// an expired session goes back to log in
+			if err := session.Valid("user"); err != nil {
+				fmt.Println(err)
+				fmt.Println("")
+				session = nil
+				break
+			}
+
+			switch option {
+			case 0:
+				CheckBalance(client, session)
+				fmt.Println("")
+			case 1:
+				Recharge(client, session)
+				fmt.Println("")
+			case 2:
+				Withdraw(client, session)
+				fmt.Println("")
+			case 3:
+				WithdrawalAddresses(session)
+				fmt.Println("")
+			case 4:
+				Logout(session)
+				session = nil
+				fmt.Println("")
+			case 5:
+				fmt.Println("")
+				return
+			default:
+				fmt.Println("invalid input")
+				fmt.Println("")
+			}
+		}
+
+		for session != nil && session.Role != "user" {
+			fmt.Println("please choose your option:")
+			fmt.Println("0: centralize\t1: scan deposits\t2: speed up withdrawal\t3: cancel withdrawal")
+			fmt.Println("4: reconcile\t5: export unsigned batch\t6: import signed batch")
+			fmt.Println("7: withdraw requests\t8: limit overrides\t9: rebalance hot wallet\t10: manage admins")
+			fmt.Println("11: audit log\t12: log out\t13: exit")
+
+			_, err := fmt.Scanln(&option)
+			if err != nil {
+				fmt.Println("invalid input")
+				continue
+			}
+
+			// an expired session goes back to log in
+			if err := session.Valid(session.Role); err != nil {
+				fmt.Println(err)
+				fmt.Println("")
+				session = nil
+				break
+			}
+
+			switch option {
+			case 0:
+				Centralize(client, session)
+				fmt.Println("")
+			case 1:
+				ScanAllDeposits(client, session)
+				fmt.Println("")
+			case 2:
+				SpeedUpOrCancel(client, session, false)
+				fmt.Println("")
+			case 3:
+				SpeedUpOrCancel(client, session, true)
+				fmt.Println("")
+			case 4:
+				ReconcileAccounts(client, session)
+				fmt.Println("")
+			case 5:
+				ExportOffline(client, session)
+				fmt.Println("")
+			case 6:
+				ImportOffline(client, session)
+				fmt.Println("")
+			case 7:
+				ReviewWithdrawRequests(client, session)
+				fmt.Println("")
+			case 8:
+				ManageOverrides(session)
+				fmt.Println("")
+			case 9:
+				RebalanceWallets(client, session)
+				fmt.Println("")
+			case 10:
+				ManageAdmins(session)
+				fmt.Println("")
+			case 11:
+				ViewAuditLog(session)
+				fmt.Println("")
+			case 12:
+				Logout(session)
+				session = nil
+				fmt.Println("")
+			case 13:
+				fmt.Println("")
+				return
+			default:
+				fmt.Println("invalid input")
+				fmt.Println("")
+			}
 		}
 	}
 }
+
+// startClient : connect to the node and start the background workers
+func startClient() (*ethclient.Client, error) {
+	client, err := ethclient.Dial(config.RPCAddress)
+	if err != nil {
+		return nil, errors.New("fail to connect: " + err.Error())
+	}
+
+	// pick up nonces used while the system was down
+	err = ReconcileNonces(client)
+	if err != nil {
+		return nil, err
+	}
+
+	// credit deposits and speed up stuck withdrawals in the background
+	go WatchDeposits(client)
+	go WatchStuckTransactions(client)
+	if config.ColdAddress != "" {
+		go WatchHotWallet(client)
+	}
+
+	return client, nil
+}
+
+// SignBatchFile : sign the batch in path with the keystore and the master seed, returns the signed batch file
+func SignBatchFile(path string) (string, error) {
+	batch, err := ReadBatch(path)
+	if err != nil {
+		return "", errors.New("fail to read batch: " + err.Error())
+	}
+
+	keystorepassword, err = config.KeystorePassword()
+	if err != nil {
+		return "", err
+	}
+	if config.KeystoreDir != "" {
+		keys = OpenKeystore(config.KeystoreDir)
+	}
+
+	seed, err := config.MasterSeed()
+	if err != nil {
+		return "", err
+	}
+	if seed != "" {
+		master, err = OpenMasterWallet(seed)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = SignBatch(batch)
+	if err != nil {
+		return "", err
+	}
+
+	signedpath := strings.TrimSuffix(path, ".json") + ".signed.json"
+	err = WriteBatch(batch, signedpath)
+	if err != nil {
+		return "", errors.New("fail to write signed batch: " + err.Error())
+	}
+
+	return signedpath, nil
+}
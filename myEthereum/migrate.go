@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// MigrateTextLedger : import the legacy account pool file and account info files into the store
+// returns the number of imported accounts and ledgers
+func MigrateTextLedger(poolpath, infopath string) (int, int, error) {
+	// read account pool
+	accountdataptr, err := ReadFileContent(poolpath)
+	if err != nil {
+		return 0, 0, errors.New("fail to open account pool file: " + err.Error())
+	}
+
+	accounts, ok := (*accountdataptr)["accounts"].([]interface{})
+	if !ok {
+		return 0, 0, errors.New("fail to open account pool file: wrong format")
+	}
+
+	// read account info files
+	files, err := ioutil.ReadDir(infopath)
+	if err != nil {
+		return 0, 0, errors.New("fail to open account info directory: " + err.Error())
+	}
+
+	infos := make(map[string]*AccountInfo)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".txt" {
+			continue
+		}
+
+		info, err := readTextAccountInfo(filepath.Join(infopath, file.Name()))
+		if err != nil {
+			return 0, 0, errors.New("fail to read " + file.Name() + ": " + err.Error())
+		}
+
+		infos[strings.TrimSuffix(file.Name(), ".txt")] = info
+	}
+
+	// write everything in one transaction, so a failed migration leaves the store untouched
+	err = store.Update(func(tx StorageTx) error {
+		existing, err := tx.Keys(BucketAccounts)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return errors.New("the store already contains an account pool")
+		}
+
+		for _, v := range accounts {
+			account, ok := v.(map[string]interface{})
+			if !ok {
+				return errors.New("wrong account pool format")
+			}
+
+			var poolaccount PoolAccount
+			poolaccount.Address, _ = account["address"].(string)
+			poolaccount.Mnemonic, _ = account["mnemonic"].(string)
+			poolaccount.Status, _ = account["status"].(string)
+			if poolaccount.Address == "" || poolaccount.Status == "" {
+				return errors.New("wrong account pool format")
+			}
+
+			err = PutPoolAccount(tx, &poolaccount)
+			if err != nil {
+				return err
+			}
+		}
+
+		for address, info := range infos {
+			err = PutAccountInfo(tx, address, info)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, errors.New("fail to migrate: " + err.Error())
+	}
+
+	return len(accounts), len(infos), nil
+}
+
+// readTextAccountInfo : returns the ledger stored in a legacy account info file
+func readTextAccountInfo(path string) (*AccountInfo, error) {
+	dataptr, err := ReadFileContent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := *dataptr
+
+	info := AccountInfo{Transactions: []MyTransaction{}}
+	info.Balance, _ = data["balance"].(string)
+	info.AddrBalance, _ = data["addrbalance"].(string)
+	info.PendingBalance, _ = data["pendingbalance"].(string)
+
+	for _, amount := range []string{info.Balance, info.AddrBalance, info.PendingBalance} {
+		if _, err := ParseAmount(amount); err != nil {
+			return nil, err
+		}
+	}
+
+	transactions, _ := data["transactions"].([]interface{})
+	for _, t := range transactions {
+		txmap, _ := t.(map[string]interface{})
+		tx, err := MapToTransaction(txmap)
+		if err != nil {
+			return nil, err
+		}
+
+		info.Transactions = append(info.Transactions, *tx)
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// NonceState : the nonces reserved for a sender
+// gaps are reserved nonces that failed to broadcast, they are handed out again first
+type NonceState struct {
+	Next uint64   `json:"next"`
+	Gaps []uint64 `json:"gaps"`
+}
+
+// noncelock serializes reservations, so a nonce is never handed out twice
+var noncelock sync.Mutex
+
+// ReserveNonce : reserve the next nonce of a sender from the stored counter,
+// the node is only asked for a sender that has none yet
+func ReserveNonce(client *ethclient.Client, address string) (uint64, error) {
+	noncelock.Lock()
+	defer noncelock.Unlock()
+
+	var state NonceState
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketNonces, strings.ToLower(address), &state)
+		return err
+	})
+	if err != nil {
+		return 0, errors.New("fail to read nonces: " + err.Error())
+	}
+
+	var pending uint64
+	if !found {
+		pending, err = client.PendingNonceAt(context.Background(), common.HexToAddress(address))
+		if err != nil {
+			return 0, errors.New("fail to get nonce: " + err.Error())
+		}
+	}
+
+	var nonce uint64
+	err = store.Update(func(tx StorageTx) error {
+		var state NonceState
+		found, err := tx.Get(BucketNonces, strings.ToLower(address), &state)
+		if err != nil {
+			return err
+		}
+		if !found {
+			state = NonceState{Next: pending, Gaps: []uint64{}}
+		}
+
+		if len(state.Gaps) > 0 {
+			nonce = state.Gaps[0]
+			state.Gaps = state.Gaps[1:]
+		} else {
+			nonce = state.Next
+			state.Next++
+		}
+
+		return tx.Put(BucketNonces, strings.ToLower(address), &state)
+	})
+	if err != nil {
+		return 0, errors.New("fail to reserve nonce: " + err.Error())
+	}
+
+	return nonce, nil
+}
+
+// ReleaseNonce : give back a reserved nonce whose transaction failed to broadcast
+func ReleaseNonce(address string, nonce uint64) error {
+	noncelock.Lock()
+	defer noncelock.Unlock()
+
+	return store.Update(func(tx StorageTx) error {
+		var state NonceState
+		_, err := tx.Get(BucketNonces, strings.ToLower(address), &state)
+		if err != nil {
+			return err
+		}
+
+		if nonce >= state.Next {
+			return nil
+		}
+		for _, gap := range state.Gaps {
+			if gap == nonce {
+				return nil
+			}
+		}
+
+		state.Gaps = append(state.Gaps, nonce)
+		sort.Slice(state.Gaps, func(i, j int) bool { return state.Gaps[i] < state.Gaps[j] })
+
+		return tx.Put(BucketNonces, strings.ToLower(address), &state)
+	})
+}
+
+// ReleaseSentNonce : give back the nonce of a transaction the node refused,
+// a refusal about the nonce means it was used outside this system, so the counter is synced with the node
+func ReleaseSentNonce(client *ethclient.Client, address string, nonce uint64, err error) {
+	ReleaseNonce(address, nonce)
+	if IsNonceError(err) {
+		ResyncNonce(client, address)
+	}
+}
+
+// ResyncNonce : move the counter of a sender past the nonces the node has already seen
+func ResyncNonce(client *ethclient.Client, address string) error {
+	noncelock.Lock()
+	defer noncelock.Unlock()
+
+	pending, err := client.PendingNonceAt(context.Background(), common.HexToAddress(address))
+	if err != nil {
+		return errors.New("fail to get nonce: " + err.Error())
+	}
+
+	return store.Update(func(tx StorageTx) error {
+		var state NonceState
+		_, err := tx.Get(BucketNonces, strings.ToLower(address), &state)
+		if err != nil {
+			return err
+		}
+
+		dropUsedNonces(&state, pending)
+
+		return tx.Put(BucketNonces, strings.ToLower(address), &state)
+	})
+}
+
+// IsNonceError : returns whether the node refused a transaction for its nonce
+func IsNonceError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "nonce too")
+}
+
+// ReconcileNonces : reset the nonces of all known senders to the node's pending nonce,
+// nonces reserved before a restart that never reached the node are reused,
+// except those of transactions exported for offline signing, which stay reserved until imported or released
+func ReconcileNonces(client *ethclient.Client) error {
+	noncelock.Lock()
+	defer noncelock.Unlock()
+
+	var senders []string
+	exported := make(map[string]map[uint64]bool)
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		senders, err = tx.Keys(BucketNonces)
+		if err != nil {
+			return err
+		}
+
+		keys, err := tx.Keys(BucketExported)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			var unsigned UnsignedTx
+			if _, err := tx.Get(BucketExported, key, &unsigned); err != nil {
+				return err
+			}
+
+			sender := strings.ToLower(unsigned.From)
+			if exported[sender] == nil {
+				exported[sender] = make(map[uint64]bool)
+				senders = append(senders, sender)
+			}
+			exported[sender][unsigned.Nonce] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.New("fail to read nonces: " + err.Error())
+	}
+
+	// the hot wallet is reconciled even before its first send
+	senders = append(senders, strings.ToLower(config.MainAddress))
+
+	done := make(map[string]bool)
+	for _, sender := range senders {
+		if done[sender] {
+			continue
+		}
+		done[sender] = true
+
+		pending, err := client.PendingNonceAt(context.Background(), common.HexToAddress(sender))
+		if err != nil {
+			return errors.New("fail to get nonce: " + err.Error())
+		}
+
+		// nonces below the last exported one that are not exported are handed out again
+		state := NonceState{Next: pending, Gaps: []uint64{}}
+		for nonce := range exported[sender] {
+			if nonce >= state.Next {
+				state.Next = nonce + 1
+			}
+		}
+		for nonce := pending; nonce < state.Next; nonce++ {
+			if !exported[sender][nonce] {
+				state.Gaps = append(state.Gaps, nonce)
+			}
+		}
+
+		err = store.Update(func(tx StorageTx) error {
+			return tx.Put(BucketNonces, sender, &state)
+		})
+		if err != nil {
+			return errors.New("fail to write nonces: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// dropUsedNonces : move the state past the nonces the node has already seen
+func dropUsedNonces(state *NonceState, pending uint64) {
+	if state.Next < pending {
+		state.Next = pending
+	}
+
+	gaps := []uint64{}
+	for _, gap := range state.Gaps {
+		if gap >= pending {
+			gaps = append(gaps, gap)
+		}
+	}
+	state.Gaps = gaps
+}
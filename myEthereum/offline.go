@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// UnsignedTx : a transaction built online to be signed offline
+// Ledger is the address whose ledger records the transaction, Request is the approved withdraw request
+// of a withdrawal above ApprovalThreshold, Derived and Index tell the signer where the key of From is,
+// Hash and Raw are filled in by the signer
+type UnsignedTx struct {
+	Ledger      string `json:"ledger"`
+	Type        string `json:"type"`
+	ChainID     string `json:"chainid"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Value       string `json:"value"`
+	Nonce       uint64 `json:"nonce"`
+	Gas         uint64 `json:"gas"`
+	GasEstimate uint64 `json:"gasestimate"`
+	GasPrice    string `json:"gasprice,omitempty"`
+	GasFeeCap   string `json:"gasfeecap,omitempty"`
+	GasTipCap   string `json:"gastipcap,omitempty"`
+	Data        string `json:"data,omitempty"`
+	Request     uint64 `json:"request,omitempty"`
+	Derived     bool   `json:"derived,omitempty"`
+	Index       uint64 `json:"index,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	Raw         string `json:"raw,omitempty"`
+}
+
+// OfflineBatch : the file carried between the online machine and the offline signer
+type OfflineBatch struct {
+	Created      int64        `json:"created"`
+	Transactions []UnsignedTx `json:"transactions"`
+}
+
+// Transaction : returns the unsigned transaction
+func (u *UnsignedTx) Transaction() (*types.Transaction, error) {
+	chainID, err := ParseAmount(u.ChainID)
+	if err != nil {
+		return nil, errors.New("fail to get chain id: " + err.Error())
+	}
+	value, err := ParseAmount(u.Value)
+	if err != nil {
+		return nil, errors.New("fail to get amount: " + err.Error())
+	}
+
+	fees := &FeeParams{}
+	if u.GasFeeCap != "" {
+		fees.GasFeeCap, err = ParseAmount(u.GasFeeCap)
+		if err == nil {
+			fees.GasTipCap, err = ParseAmount(u.GasTipCap)
+		}
+	} else {
+		fees.GasPrice, err = ParseAmount(u.GasPrice)
+	}
+	if err != nil {
+		return nil, errors.New("fail to get gas price: " + err.Error())
+	}
+
+	var data []byte
+	if u.Data != "" {
+		data, err = hexutil.Decode(u.Data)
+		if err != nil {
+			return nil, errors.New("fail to get call data: " + err.Error())
+		}
+	}
+
+	return NewFeeTransaction(chainID, u.Nonce, common.HexToAddress(u.To), value, u.Gas, fees, data), nil
+}
+
+// MaxFee : returns the most the transaction can pay in fees, its gas limit at its fee cap or gas price
+func (u *UnsignedTx) MaxFee() (*big.Int, error) {
+	price := u.GasFeeCap
+	if price == "" {
+		price = u.GasPrice
+	}
+
+	maxprice, err := ParseAmount(price)
+	if err != nil {
+		return nil, errors.New("fail to get gas price: " + err.Error())
+	}
+
+	return maxprice.Mul(maxprice, new(big.Int).SetUint64(u.Gas)), nil
+}
+
+// ExportWithdrawal : returns an unsigned withdrawal of value to to on behalf of address, request is the
+// approved withdraw request of a withdrawal above ApprovalThreshold, the withdrawal is checked again when it is imported
+func ExportWithdrawal(client *ethclient.Client, address, to string, value *big.Int, request uint64) (*UnsignedTx, error) {
+	unlock := LockWithdrawal(address)
+	defer unlock()
+
+	_, err := CheckWithdrawal(client, address, to, value, request)
+	if err != nil {
+		return nil, err
+	}
+
+	unsigned, err := BuildTransaction(client, value, config.MainAddress, to, "1")
+	if err != nil {
+		return nil, errors.New("fail to build withdrawal: " + err.Error())
+	}
+	unsigned.Ledger = strings.ToLower(address)
+	unsigned.Request = request
+
+	return unsigned, nil
+}
+
+// ExportCentralize : returns unsigned transactions moving the ether of every assigned address to the hot wallet,
+// less the gas, as centralize does, tokens are only swept online
+func ExportCentralize(client *ethclient.Client) ([]UnsignedTx, error) {
+	info, ok := RefreshAllAccount(client)
+	if !ok {
+		return nil, errors.New("fail to refresh balance")
+	}
+
+	block, err := confirmedHead(client)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := []UnsignedTx{}
+	for _, userinfo := range *info {
+		pending, err := hasPendingSweep(userinfo["address"])
+		if err != nil || pending {
+			continue
+		}
+
+		var account *PoolAccount
+		err = store.View(func(tx StorageTx) error {
+			account, err = GetPoolAccount(tx, userinfo["address"])
+			return err
+		})
+		if err != nil || account == nil {
+			ReleaseBatch(&OfflineBatch{Transactions: transactions})
+			return nil, errors.New("fail to open account pool for " + userinfo["address"])
+		}
+
+		unsigned, _, err := buildSweep(client, userinfo["address"], block)
+		if err != nil {
+			ReleaseBatch(&OfflineBatch{Transactions: transactions})
+			return nil, errors.New("fail to build centralize of " + userinfo["address"] + ": " + err.Error())
+		}
+		if unsigned == nil {
+			continue
+		}
+		unsigned.Derived = account.Derived
+		unsigned.Index = account.Index
+
+		transactions = append(transactions, *unsigned)
+	}
+
+	return transactions, nil
+}
+
+// ReleaseBatch : hand the nonces of a batch that will never be sent out again,
+// its transactions can no longer be imported
+func ReleaseBatch(batch *OfflineBatch) {
+	for _, unsigned := range batch.Transactions {
+		releaseExported(unsigned.From, unsigned.Nonce)
+	}
+}
+
+// ExportBatch : keep a copy of every transaction of a batch, then write it to path,
+// only transactions matching a kept copy are imported, and a kept withdrawal reserves its amount
+func ExportBatch(batch *OfflineBatch, path string) error {
+	err := store.Update(func(tx StorageTx) error {
+		for i := range batch.Transactions {
+			unsigned := &batch.Transactions[i]
+			err := tx.Put(BucketExported, exportKey(unsigned.From, unsigned.Nonce), unsigned)
+			if err != nil {
+				return err
+			}
+
+			if unsigned.Type == "1" {
+				err = syncLedger(tx, unsigned.Ledger)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.New("fail to save exported transactions: " + err.Error())
+	}
+
+	return WriteBatch(batch, path)
+}
+
+// GetExported : returns the kept copy of the transaction exported from sender with nonce, nil if there is none
+func GetExported(from string, nonce uint64) (*UnsignedTx, error) {
+	var unsigned UnsignedTx
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketExported, exportKey(from, nonce), &unsigned)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("fail to open exported transactions: " + err.Error())
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &unsigned, nil
+}
+
+// forgetExported : drop the kept copy of an exported transaction once it is imported or given up,
+// releasing the amount a withdrawal reserves
+func forgetExported(from string, nonce uint64) error {
+	return store.Update(func(tx StorageTx) error {
+		var unsigned UnsignedTx
+		found, err := tx.Get(BucketExported, exportKey(from, nonce), &unsigned)
+		if err != nil || !found {
+			return err
+		}
+
+		err = tx.Delete(BucketExported, exportKey(from, nonce))
+		if err != nil {
+			return err
+		}
+
+		if unsigned.Type != "1" {
+			return nil
+		}
+		return syncLedger(tx, unsigned.Ledger)
+	})
+}
+
+// releaseExported : give up an exported transaction, handing its nonce out again
+func releaseExported(from string, nonce uint64) error {
+	err := forgetExported(from, nonce)
+	if err != nil {
+		return err
+	}
+
+	return ReleaseNonce(from, nonce)
+}
+
+// ExportedBalance : returns the amount the exported withdrawals of address keep from its balance
+// until they are imported or given up, a withdrawal of a withdraw request is reserved by the request
+func ExportedBalance(stx StorageTx, address string) (*big.Int, error) {
+	keys, err := stx.Keys(BucketExported)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := new(big.Int)
+	for _, key := range keys {
+		var unsigned UnsignedTx
+		if _, err := stx.Get(BucketExported, key, &unsigned); err != nil {
+			return nil, err
+		}
+		if unsigned.Type != "1" || unsigned.Request != 0 || !strings.EqualFold(unsigned.Ledger, address) {
+			continue
+		}
+
+		amount, err := ReservedAmount(&MyTransaction{
+			Amount:    unsigned.Value,
+			Gas:       unsigned.Gas,
+			GasPrice:  unsigned.GasPrice,
+			GasFeeCap: unsigned.GasFeeCap,
+		})
+		if err != nil {
+			return nil, err
+		}
+		exported.Add(exported, amount)
+	}
+
+	return exported, nil
+}
+
+// WriteBatch : write a batch to path
+func WriteBatch(batch *OfflineBatch, path string) error {
+	data, err := json.MarshalIndent(batch, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// ReadBatch : returns the batch in path
+func ReadBatch(path string) (*OfflineBatch, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch OfflineBatch
+	err = json.Unmarshal(data, &batch)
+	if err != nil {
+		return nil, errors.New("fail to parse batch: " + err.Error())
+	}
+
+	return &batch, nil
+}
+
+// SignBatch : sign every transaction of a batch, needs the keystore and the master seed but no node or store,
+// a batch holding a transaction that does not pay where its type must is not signed at all
+func SignBatch(batch *OfflineBatch) error {
+	for i := range batch.Transactions {
+		err := checkPayee(&batch.Transactions[i])
+		if err != nil {
+			return errors.New("refuse to sign transaction from " + batch.Transactions[i].From + ": " + err.Error())
+		}
+	}
+
+	for i := range batch.Transactions {
+		unsigned := &batch.Transactions[i]
+
+		var privateKey *ecdsa.PrivateKey
+		var err error
+		if unsigned.Derived {
+			privateKey, err = DeriveKey(unsigned.Index)
+		} else {
+			privateKey, err = KeystoreKey(unsigned.From)
+		}
+		if err != nil {
+			return errors.New("fail to get privateKey of " + unsigned.From + ": " + err.Error())
+		}
+
+		err = unsigned.Sign(privateKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPayee : returns an error unless a transaction pays where its type must
+//  1: a withdrawal from the hot wallet, its payee is checked against the whitelist online, at export and import
+//  2: a centralize of ether or a listed token to the hot wallet
+//  4: a refill from the cold wallet to the hot wallet
+func checkPayee(unsigned *UnsignedTx) error {
+	var data []byte
+	if unsigned.Data != "" {
+		var err error
+		data, err = hexutil.Decode(unsigned.Data)
+		if err != nil {
+			return errors.New("fail to get call data: " + err.Error())
+		}
+	}
+
+	switch unsigned.Type {
+	case "1":
+		if !strings.EqualFold(unsigned.From, config.MainAddress) || len(data) > 0 {
+			return errors.New("a withdrawal must be a transfer from the hot wallet")
+		}
+		return nil
+	case "2":
+		if strings.EqualFold(unsigned.To, config.MainAddress) && len(data) == 0 {
+			return nil
+		}
+		for _, token := range config.Tokens {
+			if !strings.EqualFold(unsigned.To, token) {
+				continue
+			}
+
+			to, _, err := ParseTransferData(data)
+			if err != nil {
+				return err
+			}
+			value, err := ParseAmount(unsigned.Value)
+			if err != nil {
+				return errors.New("fail to get amount: " + err.Error())
+			}
+			if !strings.EqualFold(to, config.MainAddress) || value.Sign() != 0 {
+				return errors.New("a token centralize must transfer to the hot wallet")
+			}
+			return nil
+		}
+		return errors.New("a centralize must pay the hot wallet")
+	case "4":
+		if config.ColdAddress == "" || !strings.EqualFold(unsigned.From, config.ColdAddress) ||
+			!strings.EqualFold(unsigned.To, config.MainAddress) || len(data) > 0 {
+			return errors.New("a refill must be a transfer from the cold wallet to the hot wallet")
+		}
+		return nil
+	default:
+		return errors.New("transactions of type " + unsigned.Type + " are not signed offline")
+	}
+}
+
+// Sign : sign the transaction with the key of From, filling in Hash and Raw
+func (u *UnsignedTx) Sign(privateKey *ecdsa.PrivateKey) error {
+	if !strings.EqualFold(crypto.PubkeyToAddress(privateKey.PublicKey).Hex(), u.From) {
+		return errors.New("the key found for " + u.From + " belongs to another address")
+	}
+
+	tx, err := u.Transaction()
+	if err != nil {
+		return err
+	}
+
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(tx.ChainId()), privateKey)
+	if err != nil {
+		return errors.New("fail to sign: " + err.Error())
+	}
+
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return errors.New("fail to sign: " + err.Error())
+	}
+
+	u.Hash = signedTx.Hash().Hex()
+	u.Raw = hexutil.Encode(raw)
+	return nil
+}
+
+// Signed : returns the signed transaction in Raw
+func (u *UnsignedTx) Signed() (*types.Transaction, error) {
+	if u.Raw == "" {
+		return nil, errors.New("transaction is not signed")
+	}
+
+	raw, err := hexutil.Decode(u.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	signedTx := new(types.Transaction)
+	err = signedTx.UnmarshalBinary(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return signedTx, nil
+}
+
+// ledgerHas : returns true if the ledger of address has recorded the transaction hash
+func ledgerHas(address, hash string) (bool, error) {
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		info, err := GetAccountInfo(tx, address)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range info.Transactions {
+			if strings.EqualFold(t.Hash, hash) {
+				found = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, errors.New("fail to open account info: " + err.Error())
+	}
+
+	return found, nil
+}
+
+// ImportBatch : broadcast the signed transactions of a batch and save them to the ledger,
+// returns the number of transactions sent, keeps going past failures and returns the last one
+func ImportBatch(client *ethclient.Client, batch *OfflineBatch) (int, error) {
+	sent := 0
+	var lasterr error
+	for i := range batch.Transactions {
+		err := importTransaction(client, &batch.Transactions[i])
+		if err != nil {
+			lasterr = errors.New("fail to import " + batch.Transactions[i].Hash + ": " + err.Error())
+			continue
+		}
+		sent++
+	}
+
+	return sent, lasterr
+}
+
+// importTransaction : check a signed transaction against the copy kept when it was exported, then send and save it,
+// nothing in the batch file but the signed transaction is trusted
+func importTransaction(client *ethclient.Client, signed *UnsignedTx) error {
+	signedTx, err := signed.Signed()
+	if err != nil {
+		return err
+	}
+	sender, err := types.Sender(types.LatestSignerForChainID(signedTx.ChainId()), signedTx)
+	if err != nil {
+		return err
+	}
+
+	unsigned, err := GetExported(sender.Hex(), signedTx.Nonce())
+	if err != nil {
+		return err
+	}
+	if unsigned == nil {
+		return errors.New("transaction was not exported, or was already imported")
+	}
+
+	// the signer must have signed exactly what was exported
+	expected, err := unsigned.Transaction()
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sender.Hex(), unsigned.From) || signedTx.Nonce() != expected.Nonce() ||
+		signedTx.To() == nil || *signedTx.To() != *expected.To() || signedTx.Value().Cmp(expected.Value()) != 0 ||
+		signedTx.Gas() != expected.Gas() || signedTx.GasFeeCap().Cmp(expected.GasFeeCap()) != 0 ||
+		signedTx.GasTipCap().Cmp(expected.GasTipCap()) != 0 || signedTx.ChainId().Cmp(expected.ChainId()) != 0 ||
+		!bytes.Equal(signedTx.Data(), expected.Data()) {
+		return errors.New("signed transaction does not match the exported one")
+	}
+
+	// importing the same batch twice must not record a transaction twice
+	imported, err := ledgerHas(unsigned.Ledger, signedTx.Hash().Hex())
+	if err != nil {
+		return err
+	}
+	if imported {
+		forgetExported(unsigned.From, unsigned.Nonce)
+		return errors.New("already imported")
+	}
+
+	if unsigned.Type == "1" {
+		unlock := LockWithdrawal(unsigned.Ledger)
+		defer unlock()
+	}
+
+	// from here the transaction is either sent or given up, the withdrawal checks
+	// its balance without the reservation of its own kept copy
+	err = forgetExported(unsigned.From, unsigned.Nonce)
+	if err != nil {
+		return errors.New("fail to release exported transaction: " + err.Error())
+	}
+
+	// the balance may have changed while the batch was offline
+	if unsigned.Type == "1" {
+		_, err = CheckWithdrawal(client, unsigned.Ledger, unsigned.To, expected.Value(), unsigned.Request)
+		if err != nil {
+			ReleaseNonce(unsigned.From, unsigned.Nonce)
+			return err
+		}
+	}
+
+	err = client.SendTransaction(context.Background(), signedTx)
+	if err != nil {
+		ReleaseSentNonce(client, unsigned.From, unsigned.Nonce, err)
+		return err
+	}
+
+	mytx, err := DecomposeTransaction(client, signedTx, unsigned.Type)
+	if err != nil {
+		return err
+	}
+	mytx.GasEstimate = unsigned.GasEstimate
+	mytx.Created = time.Now().Unix()
+
+	err = SaveATransaction(unsigned.Ledger, mytx)
+	if err != nil {
+		return err
+	}
+
+	if unsigned.Request != 0 {
+		return RequestSent(unsigned.Request, mytx.Hash)
+	}
+
+	// a refill of the hot wallet is no longer outstanding once it is sent
+	if unsigned.Type == "4" {
+		return ClearRefillRequest(unsigned.Nonce)
+	}
+
+	return nil
+}
+
+func exportKey(from string, nonce uint64) string {
+	return strings.ToLower(from) + "/" + fmt.Sprintf("%016d", nonce)
+}
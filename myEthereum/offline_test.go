@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// exportWithdrawal : export a withdrawal of value from address to to as a batch file, returns the batch
+func (e *testEnv) exportWithdrawal(address, to string, value *big.Int) *OfflineBatch {
+	unsigned, err := ExportWithdrawal(e.client, address, to, value, 0)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	batch := &OfflineBatch{Created: time.Now().Unix(), Transactions: []UnsignedTx{*unsigned}}
+	err = ExportBatch(batch, filepath.Join(e.t.TempDir(), "batch.json"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return batch
+}
+
+// balance : returns the balance the user of token may withdraw
+func (e *testEnv) balance(token string) string {
+	status, reply := e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusOK {
+		e.t.Fatalf("balance: status %d, %v", status, reply)
+	}
+
+	return reply["balance"].(string)
+}
+
+func TestExportedWithdrawal(t *testing.T) {
+	e := newTestEnv(t)
+	token, address := e.register("alice")
+	e.deposit(address, ether(1))
+
+	destination := crypto.PubkeyToAddress(e.payer.PublicKey).Hex()
+	status, reply := e.call(http.MethodPost, "/whitelist/add", token, map[string]string{"address": destination, "label": "payer"})
+	if status != http.StatusOK {
+		t.Fatalf("whitelist add: status %d, %v", status, reply)
+	}
+
+	// an exported withdrawal reserves its amount until it is imported or released
+	half := new(big.Int).Div(ether(1), big.NewInt(2))
+	batch := e.exportWithdrawal(address, destination, half)
+	if balance := e.balance(token); balance != half.String() {
+		t.Errorf("balance with an exported withdrawal: %s, want %s", balance, half)
+	}
+
+	_, err := ExportWithdrawal(e.client, address, destination, ether(1), 0)
+	if err == nil || !strings.Contains(err.Error(), "not enough") {
+		t.Errorf("export of more than the balance left: %v, want not enough", err)
+	}
+
+	ReleaseBatch(batch)
+	if balance := e.balance(token); balance != ether(1).String() {
+		t.Errorf("balance after the release: %s, want %s", balance, ether(1))
+	}
+
+	batch = e.exportWithdrawal(address, destination, half)
+	err = SignBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := ImportBatch(e.client, batch)
+	if err != nil || sent != 1 {
+		t.Fatalf("import: %d sent, %v", sent, err)
+	}
+
+	e.sim.Commit()
+	if balance := e.balance(token); balance != half.String() {
+		t.Errorf("balance after the import: %s, want %s", balance, half)
+	}
+
+	// a batch is imported once
+	sent, _ = ImportBatch(e.client, batch)
+	if sent != 0 {
+		t.Errorf("import twice: %d sent, want 0", sent)
+	}
+}
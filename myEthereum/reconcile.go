@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Discrepancy : a difference between the ledger and the chain for an address
+type Discrepancy struct {
+	Address string `json:"address"`
+	Ledger  string `json:"ledger"`
+	Chain   string `json:"chain"`
+	Delta   string `json:"delta"`
+	Cause   string `json:"cause"`
+}
+
+// Adjustment : a proposed correction of a user's addrbalance, for review
+type Adjustment struct {
+	Address string `json:"address"`
+	Field   string `json:"field"`
+	Amount  string `json:"amount"`
+	Cause   string `json:"cause"`
+}
+
+// ReconcileReport : the result of reconciling the ledger against the chain at a block
+type ReconcileReport struct {
+	Block         uint64        `json:"block"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Liabilities   string        `json:"liabilities"`
+	Assets        string        `json:"assets"`
+	Covered       bool          `json:"covered"`
+	Adjustments   []Adjustment  `json:"adjustments"`
+}
+
+// Reconcile : compare the ledger of every assigned address with its on-chain balance at block,
+// and the sum of user balances with the balances of the hot and cold wallets, the gas station and all assigned addresses
+func Reconcile(client *ethclient.Client, block uint64) (*ReconcileReport, error) {
+	head, err := client.BlockNumber(context.Background())
+	if err != nil {
+		return nil, errors.New("fail to get block number: " + err.Error())
+	}
+	if block > head {
+		return nil, errors.New("block " + strconv.FormatUint(block, 10) + " is not mined yet")
+	}
+
+	// read assigned addresses and their ledgers as of block
+	infos := make(map[string]*AccountInfo)
+	addresses := []string{}
+	var balances, addrbalances map[string]*big.Int
+	err = store.View(func(tx StorageTx) error {
+		accounts, err := GetPoolAccounts(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, account := range accounts {
+			if account.Status != "1" {
+				continue
+			}
+
+			info, err := GetAccountInfo(tx, account.Address)
+			if err != nil {
+				return err
+			}
+
+			infos[account.Address] = info
+			addresses = append(addresses, account.Address)
+		}
+
+		balances, addrbalances, err = LedgersAt(tx, infos, block)
+		if err != nil {
+			return errors.New("fail to replay journal: " + err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open account info: " + err.Error())
+	}
+
+	number := new(big.Int).SetUint64(block)
+	report := ReconcileReport{Block: block, Discrepancies: []Discrepancy{}, Adjustments: []Adjustment{}}
+
+	assets, err := client.BalanceAt(context.Background(), common.HexToAddress(config.MainAddress), number)
+	if err != nil {
+		return nil, errors.New("fail to get balance: " + err.Error())
+	}
+	for _, wallet := range []string{config.ColdAddress, config.GasStation} {
+		if wallet == "" {
+			continue
+		}
+
+		balance, err := client.BalanceAt(context.Background(), common.HexToAddress(wallet), number)
+		if err != nil {
+			return nil, errors.New("fail to get balance: " + err.Error())
+		}
+		assets.Add(assets, balance)
+	}
+	liabilities := new(big.Int)
+
+	for _, address := range addresses {
+		info := infos[address]
+		balance, addrbalance := balances[address], addrbalances[address]
+		liabilities.Add(liabilities, balance)
+
+		chain, err := client.BalanceAt(context.Background(), common.HexToAddress(address), number)
+		if err != nil {
+			return nil, errors.New("fail to get balance: " + err.Error())
+		}
+		assets.Add(assets, chain)
+
+		delta := new(big.Int).Sub(chain, addrbalance)
+		if delta.Sign() == 0 {
+			continue
+		}
+
+		cause, err := likelyCause(client, info, block, head, delta)
+		if err != nil {
+			return nil, err
+		}
+
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{
+			Address: address,
+			Ledger:  addrbalance.String(),
+			Chain:   chain.String(),
+			Delta:   delta.String(),
+			Cause:   cause,
+		})
+		report.Adjustments = append(report.Adjustments, Adjustment{
+			Address: address,
+			Field:   "addrbalance",
+			Amount:  delta.String(),
+			Cause:   cause,
+		})
+	}
+
+	report.Liabilities = liabilities.String()
+	report.Assets = assets.String()
+	report.Covered = assets.Cmp(liabilities) >= 0
+
+	return &report, nil
+}
+
+// LedgersAt : returns the balance and addrbalance of each ledger of infos replayed from the journal up to block,
+// the entries of a transaction settled after block are left out, opening entries and transactions
+// settled before blocks were recorded are always included
+func LedgersAt(stx StorageTx, infos map[string]*AccountInfo, block uint64) (map[string]*big.Int, map[string]*big.Int, error) {
+	balances := make(map[string]*big.Int)
+	addrbalances := make(map[string]*big.Int)
+	useraccounts := make(map[string]string)
+	depositaccounts := make(map[string]string)
+	later := make(map[string]bool)
+	for address, info := range infos {
+		balances[address] = new(big.Int)
+		addrbalances[address] = new(big.Int)
+		useraccounts[UserAccount(address)] = address
+		depositaccounts[DepositAccount(address)] = address
+
+		for _, tx := range info.Transactions {
+			if tx.BlockHash != "" && tx.BlockNumber > block {
+				later[strings.ToLower(tx.Hash)] = true
+			}
+		}
+	}
+
+	keys, err := stx.Keys(BucketJournal)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, key := range keys {
+		var entry JournalEntry
+		if _, err := stx.Get(BucketJournal, key, &entry); err != nil {
+			return nil, nil, err
+		}
+		if later[strings.ToLower(entry.Ref)] {
+			continue
+		}
+
+		for _, posting := range entry.Postings {
+			amount, err := ParseAmount(posting.Amount)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			// the user's balance is a liability, it grows with credits
+			if address, ok := useraccounts[posting.Account]; ok {
+				balances[address].Sub(balances[address], amount)
+			}
+			if address, ok := depositaccounts[posting.Account]; ok {
+				addrbalances[address].Add(addrbalances[address], amount)
+			}
+		}
+	}
+
+	return balances, addrbalances, nil
+}
+
+// SaveAdjustments : write the adjustments of a report to a new json journal file for review,
+// named after the block and the time of the run, an existing journal is never overwritten
+func SaveAdjustments(report *ReconcileReport) (string, error) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	path := config.DataPath(ReconcilePrefix) + strconv.FormatUint(report.Block, 10) + "-" + time.Now().Format("20060102-150405") + ".json"
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// likelyCause : guess why the chain holds delta more than the ledger of an address
+func likelyCause(client *ethclient.Client, info *AccountInfo, block, head uint64, delta *big.Int) (string, error) {
+	// a settled transaction from a block that is no longer canonical
+	for i := range info.Transactions {
+		tx := &info.Transactions[i]
+		if (tx.Status != "1" && tx.Status != "2") || tx.BlockHash == "" || tx.BlockNumber > block {
+			continue
+		}
+
+		canonical, err := IsCanonical(client, tx, head)
+		if err != nil {
+			return "", errors.New("fail to check block: " + err.Error())
+		}
+		if !canonical {
+			return "orphaned transaction " + tx.Hash, nil
+		}
+	}
+
+	// value arrived that was never credited
+	if delta.Sign() > 0 {
+		return "missed deposit", nil
+	}
+
+	// value left for fees that were never recorded
+	for i := range info.Transactions {
+		tx := &info.Transactions[i]
+		if tx.Type == "2" && (tx.Status == "1" || tx.Status == "2") && tx.Fee == "" {
+			return "unrecorded fee", nil
+		}
+	}
+
+	return "unknown", nil
+}
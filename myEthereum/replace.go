@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// ReplaceTransaction : re-sign a pending withdrawal with the same nonce and higher fees,
+// or with a zero-value send to the sender itself if cancel is set, returns the new hash
+func ReplaceTransaction(client *ethclient.Client, address, hash string, cancel bool) (*string, error) {
+	// find the transaction
+	var old MyTransaction
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		info, err := GetAccountInfo(tx, address)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range info.Transactions {
+			if strings.EqualFold(t.Hash, hash) {
+				old = t
+				found = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open account info: " + err.Error())
+	}
+
+	if !found {
+		return nil, errors.New("no such transaction")
+	}
+	if old.Type != "1" || old.Status != "0" {
+		return nil, errors.New("only pending withdrawals can be replaced")
+	}
+	if old.ReplacedBy != "" {
+		return nil, errors.New("transaction has been replaced by " + old.ReplacedBy)
+	}
+	if old.From == "" {
+		return nil, errors.New("transaction was saved without its nonce and cannot be replaced")
+	}
+
+	// a mined transaction is only waiting for confirmations
+	_, err = client.TransactionReceipt(context.Background(), common.HexToHash(old.Hash))
+	if err == nil {
+		return nil, errors.New("transaction is already mined")
+	}
+	if err != ethereum.NotFound {
+		return nil, err
+	}
+
+	// bump the fees, a node only accepts a replacement paying noticeably more
+	suggested, err := SuggestFees(client)
+	if err != nil {
+		return nil, err
+	}
+
+	fees, err := BumpFees(&old, suggested)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := ParseAmount(old.Amount)
+	if err != nil {
+		return nil, errors.New("fail to get amount")
+	}
+	to := old.To
+	gasLimit := old.Gas
+	if cancel {
+		value = new(big.Int)
+		to = old.From
+		gasLimit = uint64(21000)
+	}
+
+	privateKey, err := LoadPrivateKey(old.From)
+	if err != nil {
+		return nil, errors.New("failed to get privateKey: " + err.Error())
+	}
+
+	chainID, err := client.ChainID(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	tx := NewFeeTransaction(chainID, old.Nonce, common.HexToAddress(to), value, gasLimit, fees, nil)
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.SendTransaction(context.Background(), signedTx)
+	if err != nil {
+		return nil, err
+	}
+
+	// link the replacement into the ledger
+	replacement, err := DecomposeTransaction(client, signedTx, old.Type)
+	if err != nil {
+		return nil, err
+	}
+	replacement.Replaces = old.Hash
+	if !cancel {
+		replacement.GasEstimate = old.GasEstimate
+	}
+	replacement.Created = time.Now().Unix()
+
+	err = store.Update(func(tx StorageTx) error {
+		info, err := GetAccountInfo(tx, address)
+		if err != nil {
+			return err
+		}
+
+		for i := range info.Transactions {
+			if info.Transactions[i].Hash == old.Hash {
+				info.Transactions[i].ReplacedBy = replacement.Hash
+			}
+		}
+		info.Transactions = append(info.Transactions, *replacement)
+
+		return PutAccountInfo(tx, address, info)
+	})
+	if err != nil {
+		return nil, errors.New("fail to save transaction: " + err.Error())
+	}
+
+	return &replacement.Hash, nil
+}
+
+// RebroadcastStuck : speed up every withdrawal pending for longer than StuckTimeout,
+// returns the number of replaced transactions, mined withdrawals waiting for their confirmations are left alone
+func RebroadcastStuck(client *ethclient.Client) (int, error) {
+	// collect the stuck withdrawals of all users
+	stuck := make(map[string][]string)
+	err := store.View(func(tx StorageTx) error {
+		accounts, err := GetPoolAccounts(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, account := range accounts {
+			if account.Status != "1" {
+				continue
+			}
+
+			info, err := GetAccountInfo(tx, account.Address)
+			if err != nil {
+				return err
+			}
+
+			for _, t := range info.Transactions {
+				if t.Type != "1" || t.Status != "0" || t.ReplacedBy != "" || t.From == "" {
+					continue
+				}
+				if time.Since(time.Unix(t.Created, 0)) > StuckTimeout {
+					stuck[account.Address] = append(stuck[account.Address], t.Hash)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, errors.New("fail to open account info: " + err.Error())
+	}
+
+	// keep going past failures, one withdrawal must not block the others
+	replaced := 0
+	var lasterr error
+	for address, hashes := range stuck {
+		for _, hash := range hashes {
+			_, err := client.TransactionReceipt(context.Background(), common.HexToHash(hash))
+			if err == nil {
+				continue
+			}
+			if err != ethereum.NotFound {
+				lasterr = errors.New("fail to get receipt of " + hash + ": " + err.Error())
+				continue
+			}
+
+			_, err = ReplaceTransaction(client, address, hash, false)
+			if err != nil {
+				lasterr = errors.New("fail to speed up " + hash + ": " + err.Error())
+				continue
+			}
+			replaced++
+		}
+	}
+
+	return replaced, lasterr
+}
+
+// WatchStuckTransactions : speed up stuck withdrawals periodically, never returns,
+// withdrawals are left alone while the hot wallet key is not in the keystore
+func WatchStuckTransactions(client *ethclient.Client) {
+	logged := false
+	for {
+		if !HasKey(config.MainAddress) {
+			if !logged {
+				fmt.Println("rebroadcast skipped: no key for the hot wallet " + config.MainAddress + " in the keystore")
+				logged = true
+			}
+		} else if _, err := RebroadcastStuck(client); err != nil {
+			fmt.Println("rebroadcast failed: ", err)
+		}
+
+		time.Sleep(RebroadcastInterval)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestRebroadcastSkipsMined(t *testing.T) {
+	e := newTestEnv(t)
+	token, address := e.register("alice")
+	e.deposit(address, ether(1))
+
+	destination := crypto.PubkeyToAddress(e.payer.PublicKey).Hex()
+	e.whitelist(token, destination)
+
+	tx, err := WithdrawFunds(e.client, address, destination, big.NewInt(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mined but short of its confirmations, and pending for longer than StuckTimeout
+	e.sim.Commit()
+	err = store.Update(func(stx StorageTx) error {
+		info, err := GetAccountInfo(stx, address)
+		if err != nil {
+			return err
+		}
+		for i := range info.Transactions {
+			if info.Transactions[i].Hash == tx.Hash {
+				info.Transactions[i].Created = time.Now().Add(-2 * StuckTimeout).Unix()
+			}
+		}
+		return PutAccountInfo(stx, address, info)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, err := RebroadcastStuck(e.client)
+	if err != nil || replaced != 0 {
+		t.Errorf("rebroadcast of a mined withdrawal: %d replaced, %v, want none", replaced, err)
+	}
+}
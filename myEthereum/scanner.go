@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// ScanCursor : the last block whose deposits have been credited
+type ScanCursor struct {
+	Number uint64 `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+// deposit : a transfer to an assigned address found in a block
+type deposit struct {
+	address     string
+	hash        string
+	amount      *big.Int
+	blocknumber uint64
+	blockhash   string
+}
+
+// scanlock keeps the background watcher and manual scans from walking the same blocks
+var scanlock sync.Mutex
+
+// ScanDeposits : walk the blocks after the persisted cursor up to the confirmed head and
+// credit every transfer to an assigned address, returns the number of credited deposits
+func ScanDeposits(client *ethclient.Client) (int, error) {
+	scanlock.Lock()
+	defer scanlock.Unlock()
+
+	head, err := client.BlockNumber(context.Background())
+	if err != nil {
+		return 0, errors.New("fail to get block number: " + err.Error())
+	}
+
+	depth := uint64(config.DepositConfirmations)
+	if head < depth {
+		return 0, nil
+	}
+	confirmed := head - depth
+
+	// read cursor and assigned addresses
+	var cursor ScanCursor
+	var hascursor bool
+	assigned := make(map[string]string)
+	err = store.View(func(tx StorageTx) error {
+		var err error
+		hascursor, err = tx.Get(BucketMeta, MetaScanCursor, &cursor)
+		if err != nil {
+			return err
+		}
+
+		accounts, err := GetPoolAccounts(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, account := range accounts {
+			if account.Status == "1" {
+				assigned[strings.ToLower(account.Address)] = account.Address
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, errors.New("fail to read scan cursor: " + err.Error())
+	}
+
+	next := DepositScanStart
+	if hascursor {
+		// rescan the blocks replaced by a reorg, deposits credited from them
+		// are taken back by RefreshAccountInfo
+		next, err = rewindCursor(client, cursor)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	credited := 0
+	for number := next; number <= confirmed; number++ {
+		deposits, blockhash, err := findDeposits(client, number, assigned)
+		if err != nil {
+			return credited, err
+		}
+
+		// credit the deposits and move the cursor together
+		err = store.Update(func(tx StorageTx) error {
+			for _, d := range deposits {
+				ok, err := creditDeposit(tx, d)
+				if err != nil {
+					return err
+				}
+				if ok {
+					credited++
+				}
+			}
+
+			return tx.Put(BucketMeta, MetaScanCursor, &ScanCursor{Number: number, Hash: blockhash})
+		})
+		if err != nil {
+			return credited, errors.New("fail to credit deposits: " + err.Error())
+		}
+	}
+
+	return credited, nil
+}
+
+// WatchDeposits : scan for deposits periodically, never returns
+func WatchDeposits(client *ethclient.Client) {
+	for {
+		if _, err := ScanDeposits(client); err != nil {
+			fmt.Println("deposit scan failed: ", err)
+		}
+
+		time.Sleep(DepositScanInterval)
+	}
+}
+
+// rewindCursor : returns the block to scan next, going back ReorgDepth blocks
+// if the block under the cursor has been reorganized away
+func rewindCursor(client *ethclient.Client, cursor ScanCursor) (uint64, error) {
+	// cursors saved before hashes were recorded cannot be checked
+	if cursor.Hash == "" {
+		return cursor.Number + 1, nil
+	}
+
+	header, err := client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(cursor.Number))
+	if err != nil && err != ethereum.NotFound {
+		return 0, errors.New("fail to get block: " + err.Error())
+	}
+	if err == nil && strings.EqualFold(header.Hash().Hex(), cursor.Hash) {
+		return cursor.Number + 1, nil
+	}
+
+	// crediting is idempotent, rescanning blocks that did not change is harmless
+	if cursor.Number < DepositScanStart+ReorgDepth {
+		return DepositScanStart, nil
+	}
+	return cursor.Number - ReorgDepth, nil
+}
+
+// findDeposits : returns the successful transfers to assigned addresses in a block and the block hash
+func findDeposits(client *ethclient.Client, number uint64, assigned map[string]string) ([]deposit, string, error) {
+	block, err := client.BlockByNumber(context.Background(), new(big.Int).SetUint64(number))
+	if err != nil {
+		return nil, "", errors.New("fail to get block: " + err.Error())
+	}
+	blockhash := strings.ToLower(block.Hash().Hex())
+
+	deposits := []deposit{}
+	for _, tx := range block.Transactions() {
+		if tx.To() == nil || tx.Value().Sign() <= 0 {
+			continue
+		}
+
+		address, ok := assigned[strings.ToLower(tx.To().Hex())]
+		if !ok {
+			continue
+		}
+
+		// gas sent by the gas station for a token sweep is recorded by centralize, it is not the user's
+		if config.GasStation != "" {
+			sender, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+			if err == nil && strings.EqualFold(sender.Hex(), config.GasStation) {
+				continue
+			}
+		}
+
+		// a reverted transfer moves no value
+		receipt, err := client.TransactionReceipt(context.Background(), tx.Hash())
+		if err != nil {
+			return nil, "", errors.New("fail to get receipt: " + err.Error())
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			continue
+		}
+
+		deposits = append(deposits, deposit{
+			address:     address,
+			hash:        strings.ToLower(tx.Hash().Hex()),
+			amount:      tx.Value(),
+			blocknumber: number,
+			blockhash:   blockhash,
+		})
+	}
+
+	return deposits, blockhash, nil
+}
+
+// creditDeposit : credit a deposit to the ledger of its address unless it has been credited already
+func creditDeposit(tx StorageTx, d deposit) (bool, error) {
+	info, err := GetAccountInfo(tx, d.address)
+	if err != nil {
+		return false, err
+	}
+
+	err = OpenJournal(tx, d.address, info)
+	if err != nil {
+		return false, err
+	}
+
+	// a recharge submitted through Recharge is already in the ledger
+	var record *MyTransaction
+	for i := range info.Transactions {
+		if strings.EqualFold(info.Transactions[i].Hash, d.hash) {
+			record = &info.Transactions[i]
+			break
+		}
+	}
+
+	// a credited deposit that was mined again after a reorg keeps its credit
+	if record != nil && record.Status == "1" {
+		if record.BlockHash != "" {
+			record.BlockNumber = d.blocknumber
+			record.BlockHash = d.blockhash
+		}
+		return false, PutAccountInfo(tx, d.address, info)
+	}
+
+	if record == nil {
+		info.Transactions = append(info.Transactions, MyTransaction{Hash: d.hash, Type: "0", Amount: d.amount.String(), Created: time.Now().Unix()})
+		record = &info.Transactions[len(info.Transactions)-1]
+	}
+
+	record.Status = "1"
+	record.BlockNumber = d.blocknumber
+	record.BlockHash = d.blockhash
+
+	err = PostTransaction(tx, d.address, record, false)
+	if err != nil {
+		return false, err
+	}
+
+	err = SyncBalances(tx, d.address, info)
+	if err != nil {
+		return false, err
+	}
+
+	return true, PutAccountInfo(tx, d.address, info)
+}
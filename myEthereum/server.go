@@ -0,0 +1,648 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// Server : the HTTP/JSON interface of the platform
+// endpoints
+//  POST /register: {name, password} -> {address}
+//  POST /login: {name, password} or {mnemonic} for legacy accounts -> {token, address, expires}
+//  POST /logout: {} -> {}
+//  GET /balance: -> {balance, addrbalance}
+//  GET /transactions: -> {transactions}
+//  POST /withdraw: {to, value} -> {hash}, or {request} if the value needs approval
+//  GET /withdrawrequests: -> {requests}
+//  GET /whitelist: -> {addresses}
+//  POST /whitelist/add: {address, label} -> {address}, address in its EIP-55 checksum form
+//  POST /whitelist/remove: {address} -> {}
+//  POST /admin/login: {name, password} -> {token, role, expires}
+//  POST /admin/centralize: {} for a new run or {resume} with a job id -> {job, rebalance} with a cold wallet
+//  GET /admin/centralize/jobs: -> {jobs} the latest first
+//  POST /admin/rebalance: {} -> {rebalance}
+//  GET /admin/requests: -> {requests} pending
+//  POST /admin/approve: {id} -> {request}
+//  POST /admin/reject: {id, reason} -> {request}
+//  GET /admin/overrides: -> {overrides}
+//  POST /admin/override: {address, hours, reason} -> {override}
+//  POST /admin/override/revoke: {address} -> {}
+// all endpoints but register and the logins take the session token
+// in the Authorization header as "Bearer <token>", admin actions are audited
+type Server struct {
+	client *ethclient.Client
+}
+
+// NewServer : returns a server sending transactions through client
+func NewServer(client *ethclient.Client) *Server {
+	return &Server{client: client}
+}
+
+// Handler : returns the handler serving all the endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", s.handleRegister)
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/logout", s.handleLogout)
+	mux.HandleFunc("/balance", s.handleBalance)
+	mux.HandleFunc("/transactions", s.handleTransactions)
+	mux.HandleFunc("/withdraw", s.handleWithdraw)
+	mux.HandleFunc("/withdrawrequests", s.handleWithdrawRequests)
+	mux.HandleFunc("/whitelist", s.handleWhitelist)
+	mux.HandleFunc("/whitelist/add", s.handleWhitelistAdd)
+	mux.HandleFunc("/whitelist/remove", s.handleWhitelistRemove)
+	mux.HandleFunc("/admin/login", s.handleAdminLogin)
+	mux.HandleFunc("/admin/centralize", s.handleCentralize)
+	mux.HandleFunc("/admin/centralize/jobs", s.handleCentralizeJobs)
+	mux.HandleFunc("/admin/rebalance", s.handleRebalance)
+	mux.HandleFunc("/admin/requests", s.handlePendingRequests)
+	mux.HandleFunc("/admin/approve", s.handleApprove)
+	mux.HandleFunc("/admin/reject", s.handleReject)
+	mux.HandleFunc("/admin/overrides", s.handleOverrides)
+	mux.HandleFunc("/admin/override", s.handleGrantOverride)
+	mux.HandleFunc("/admin/override/revoke", s.handleRevokeOverride)
+	return mux
+}
+
+// ListenAndServe : serve the endpoints on addr, never returns unless the listener fails
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	address, err := RegisterAnAccount(req.Name, req.Password)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"address": *address})
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Mnemonic string `json:"mnemonic"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	var session *Session
+	var err error
+	if req.Mnemonic != "" {
+		session, err = LoginAnAccount(req.Mnemonic)
+	} else {
+		session, err = LoginUser(req.Name, req.Password)
+	}
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": session.Token, "address": session.Address, "expires": session.Expires})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "")
+	if !ok {
+		return
+	}
+
+	err := EndSession(session.Token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "user")
+	if !ok {
+		return
+	}
+
+	addrbalance, balance, err := RefreshAccountInfo(s.client, session.Address)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"balance": *balance, "addrbalance": *addrbalance})
+}
+
+func (s *Server) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "user")
+	if !ok {
+		return
+	}
+
+	var transactions []MyTransaction
+	err := store.View(func(tx StorageTx) error {
+		info, err := GetAccountInfo(tx, session.Address)
+		if err != nil {
+			return err
+		}
+
+		transactions = info.Transactions
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.New("fail to open account info: "+err.Error()))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"transactions": transactions})
+}
+
+func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "user")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		To    string `json:"to"`
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	value, err := ParseAmount(req.Value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, request, err := RequestWithdrawal(s.client, session.Address, req.To, value)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if request != nil {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"request": request})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"hash": tx.Hash})
+}
+
+func (s *Server) handleWithdrawRequests(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "user")
+	if !ok {
+		return
+	}
+
+	requests, err := GetWithdrawRequests(session.Address, false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"requests": requests})
+}
+
+func (s *Server) handleWhitelist(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "user")
+	if !ok {
+		return
+	}
+
+	whitelist, err := GetWhitelist(session.Address)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"addresses": whitelist})
+}
+
+func (s *Server) handleWhitelistAdd(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "user")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Address string `json:"address"`
+		Label   string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	entry, err := AddWhitelistAddress(session.Address, req.Address, req.Label)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"address": entry})
+}
+
+func (s *Server) handleWhitelistRemove(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireSession(w, r, "user")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	err := RemoveWhitelistAddress(session.Address, req.Address)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (s *Server) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	session, err := LoginAdmin(req.Name, req.Password)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": session.Token, "role": session.Role, "expires": session.Expires})
+}
+
+func (s *Server) handleCentralize(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireAction(w, r, "centralize")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Resume uint64 `json:"resume"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	var job *CentralizeJob
+	var err error
+	if req.Resume != 0 {
+		job, err = ResumeCentralize(s.client, req.Resume)
+	} else {
+		job, err = StartCentralize(s.client, session)
+	}
+
+	// report the addresses handled before a failure too
+	detail := "centralize"
+	if job != nil {
+		detail = FormatJobSummary(*job)
+	}
+	Audit(session, "centralize", detail, err)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "job": job})
+		return
+	}
+
+	resp := map[string]interface{}{"job": job}
+
+	// move the excess of the hot wallet on to the cold wallet
+	if config.ColdAddress != "" {
+		rebalance, err := RebalanceHotWallet(s.client)
+		Audit(session, "rebalance", "rebalance after centralize", err)
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		resp["rebalance"] = rebalance
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleCentralizeJobs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if _, ok := requireAction(w, r, "centralize"); !ok {
+		return
+	}
+
+	jobs, err := GetCentralizeJobs(20)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": jobs})
+}
+
+func (s *Server) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireAction(w, r, "rebalance")
+	if !ok {
+		return
+	}
+
+	rebalance, err := RebalanceHotWallet(s.client)
+	Audit(session, "rebalance", "rebalance", err)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rebalance": rebalance})
+}
+
+func (s *Server) handlePendingRequests(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if _, ok := requireAction(w, r, "approve"); !ok {
+		return
+	}
+
+	requests, err := GetWithdrawRequests("", true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"requests": requests})
+}
+
+func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireAction(w, r, "approve")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ID uint64 `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	request, err := ApproveRequest(s.client, session, req.ID)
+	Audit(session, "approve", fmt.Sprintf("approve withdraw request #%d", req.ID), err)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"request": request})
+}
+
+func (s *Server) handleReject(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireAction(w, r, "approve")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ID     uint64 `json:"id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	request, err := RejectRequest(session, req.ID, strings.TrimSpace(req.Reason))
+	Audit(session, "approve", fmt.Sprintf("reject withdraw request #%d: %s", req.ID, req.Reason), err)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"request": request})
+}
+
+func (s *Server) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if _, ok := requireAction(w, r, "override"); !ok {
+		return
+	}
+
+	overrides, err := GetOverrides()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"overrides": overrides})
+}
+
+func (s *Server) handleGrantOverride(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireAction(w, r, "override")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Address string `json:"address"`
+		Hours   int    `json:"hours"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	override, err := GrantOverride(session, req.Address, time.Duration(req.Hours)*time.Hour, strings.TrimSpace(req.Reason))
+	Audit(session, "override", fmt.Sprintf("waive the limits of %s for %d hours: %s", req.Address, req.Hours, req.Reason), err)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"override": override})
+}
+
+func (s *Server) handleRevokeOverride(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	session, ok := requireAction(w, r, "override")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid request: "+err.Error()))
+		return
+	}
+
+	err := RevokeOverride(req.Address)
+	Audit(session, "override", "revoke the override of "+req.Address, err)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+// requireSession : returns the session of the request's bearer token,
+// or replies 401 or 403 and returns false unless it is valid and has role, any role if empty
+func requireSession(w http.ResponseWriter, r *http.Request, role string) (*Session, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	session, err := GetSession(token)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return nil, false
+	}
+	if role != "" && session.Role != role {
+		writeError(w, http.StatusForbidden, errors.New("permission denied"))
+		return nil, false
+	}
+
+	return session, true
+}
+
+// requireAction : returns the admin session of the request's bearer token,
+// or replies 401 or 403 and returns false unless its role may run action, a refusal is audited
+func requireAction(w http.ResponseWriter, r *http.Request, action string) (*Session, bool) {
+	session, ok := requireSession(w, r, "")
+	if !ok {
+		return nil, false
+	}
+
+	err := session.Allow(action)
+	if err != nil {
+		Audit(session, action, r.URL.Path, err)
+		writeError(w, http.StatusForbidden, err)
+		return nil, false
+	}
+
+	return session, true
+}
+
+// allowMethod : reply 405 and return false unless r uses method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// testMnemonic : the master seed of the test platform, never use it for real funds
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+// testEnv : a platform on a simulated chain, served over HTTP
+type testEnv struct {
+	t      *testing.T
+	sim    *simulated.Backend
+	client *ethclient.Client
+	server *httptest.Server
+	payer  *ecdsa.PrivateKey
+}
+
+// newTestEnv : returns a platform with a funded hot wallet and a funded payer outside the platform,
+// deposits are credited and transactions settled as soon as they are mined
+func newTestEnv(t *testing.T) *testEnv {
+	dir := t.TempDir()
+
+	hot, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payer, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config = &Config{
+		DataDir:              dir,
+		MainAddress:          strings.ToLower(crypto.PubkeyToAddress(hot.PublicKey).Hex()),
+		KeystoreDir:          filepath.Join(dir, "keystore"),
+		DepositConfirmations: 0,
+		SettleConfirmations:  1,
+		GasLimitMultiplier:   120,
+		GasLimitCap:          500000,
+		RequiredApprovals:    1,
+		WhitelistCooldown:    "0s",
+	}
+
+	store, err = OpenBoltStorage(filepath.Join(dir, StorageFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	master, err = OpenMasterWallet(testMnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := ExportXPub(testMnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depositxpub, err = ParseXPub(xpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keystorepassword = "hot wallet password"
+	keys = keystore.NewKeyStore(config.KeystoreDir, keystore.LightScryptN, keystore.LightScryptP)
+	if _, err := keys.ImportECDSA(hot, keystorepassword); err != nil {
+		t.Fatal(err)
+	}
+
+	sim := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(hot.PublicKey):   {Balance: ether(100)},
+		crypto.PubkeyToAddress(payer.PublicKey): {Balance: ether(100)},
+	})
+	t.Cleanup(func() { sim.Close() })
+
+	// the platform talks to a node through *ethclient.Client, the backend's client embeds one
+	client, ok := reflect.ValueOf(sim.Client()).FieldByName("Client").Interface().(*ethclient.Client)
+	if !ok {
+		t.Fatal("the simulated backend does not wrap an *ethclient.Client")
+	}
+
+	server := httptest.NewServer(NewServer(client).Handler())
+	t.Cleanup(server.Close)
+
+	return &testEnv{t: t, sim: sim, client: client, server: server, payer: payer}
+}
+
+// call : send a request to the server with the session token if any, returns the status and the decoded reply
+func (e *testEnv) call(method, path, token string, body interface{}) (int, map[string]interface{}) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, e.server.URL+path, bytes.NewReader(data))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reply := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		e.t.Fatalf("%s %s: fail to decode reply: %v", method, path, err)
+	}
+
+	return resp.StatusCode, reply
+}
+
+// register : register and log in a user, returns the session token and the deposit address
+func (e *testEnv) register(name string) (string, string) {
+	status, reply := e.call(http.MethodPost, "/register", "", map[string]string{"name": name, "password": "password " + name})
+	if status != http.StatusOK {
+		e.t.Fatalf("register %s: status %d, %v", name, status, reply)
+	}
+
+	status, reply = e.call(http.MethodPost, "/login", "", map[string]string{"name": name, "password": "password " + name})
+	if status != http.StatusOK {
+		e.t.Fatalf("login %s: status %d, %v", name, status, reply)
+	}
+
+	return reply["token"].(string), reply["address"].(string)
+}
+
+// adminLogin : create an admin with role and log it in, returns the session token
+func (e *testEnv) adminLogin(name, role string) string {
+	if err := CreateAdmin(name, "password "+name, role); err != nil {
+		e.t.Fatal(err)
+	}
+
+	status, reply := e.call(http.MethodPost, "/admin/login", "", map[string]string{"name": name, "password": "password " + name})
+	if status != http.StatusOK {
+		e.t.Fatalf("admin login %s: status %d, %v", name, status, reply)
+	}
+
+	return reply["token"].(string)
+}
+
+// whitelist : whitelist address for the user of token
+func (e *testEnv) whitelist(token, address string) {
+	status, reply := e.call(http.MethodPost, "/whitelist/add", token, map[string]string{"address": address, "label": "test"})
+	if status != http.StatusOK {
+		e.t.Fatalf("whitelist add %s: status %d, %v", address, status, reply)
+	}
+}
+
+// deposit : send value from the payer to address, mine it and credit it
+func (e *testEnv) deposit(address string, value *big.Int) {
+	ctx := context.Background()
+	from := crypto.PubkeyToAddress(e.payer.PublicKey)
+
+	nonce, err := e.client.PendingNonceAt(ctx, from)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	price, err := e.client.SuggestGasPrice(ctx)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	chainID, err := e.client.ChainID(ctx)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	tx := types.NewTransaction(nonce, common.HexToAddress(address), value, 21000, price.Mul(price, big.NewInt(2)), nil)
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), e.payer)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if err := e.client.SendTransaction(ctx, signedTx); err != nil {
+		e.t.Fatal(err)
+	}
+	e.sim.Commit()
+
+	credited, err := ScanDeposits(e.client)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if credited != 1 {
+		e.t.Fatalf("credited %d deposits, want 1", credited)
+	}
+}
+
+func ether(amount int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(amount), big.NewInt(1000000000000000000))
+}
+
+func TestRegister(t *testing.T) {
+	e := newTestEnv(t)
+
+	status, reply := e.call(http.MethodPost, "/register", "", map[string]string{"name": "alice", "password": "password alice"})
+	if status != http.StatusOK {
+		t.Fatalf("register: status %d, %v", status, reply)
+	}
+	address, _ := reply["address"].(string)
+	if !common.IsHexAddress(address) {
+		t.Fatalf("register: %q is not an address", address)
+	}
+
+	status, _ = e.call(http.MethodPost, "/register", "", map[string]string{"name": "alice", "password": "password alice"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("register twice: status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+
+	status, _ = e.call(http.MethodPost, "/register", "", map[string]string{"name": "bob", "password": "short"})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("register with a short password: status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+
+	status, _ = e.call(http.MethodGet, "/register", "", nil)
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /register: status %d, want %d", status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	e := newTestEnv(t)
+	token, address := e.register("alice")
+	if token == "" || address == "" {
+		t.Fatal("login returned no token or address")
+	}
+
+	status, _ := e.call(http.MethodPost, "/login", "", map[string]string{"name": "alice", "password": "wrong password"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	status, _ = e.call(http.MethodPost, "/login", "", map[string]string{"name": "nobody", "password": "password nobody"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login of an unknown user: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	status, _ = e.call(http.MethodPost, "/logout", token, map[string]string{})
+	if status != http.StatusOK {
+		t.Fatalf("logout: status %d", status)
+	}
+	status, _ = e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("balance after logout: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestBalanceAndTransactions(t *testing.T) {
+	e := newTestEnv(t)
+
+	for _, path := range []string{"/balance", "/transactions"} {
+		status, _ := e.call(http.MethodGet, path, "", nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("GET %s without a token: status %d, want %d", path, status, http.StatusUnauthorized)
+		}
+	}
+
+	token, address := e.register("alice")
+	e.deposit(address, ether(1))
+
+	status, reply := e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("balance: status %d, %v", status, reply)
+	}
+	if reply["balance"] != ether(1).String() || reply["addrbalance"] != ether(1).String() {
+		t.Errorf("balance: %v, want balance and addrbalance %s", reply, ether(1))
+	}
+
+	status, reply = e.call(http.MethodGet, "/transactions", token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("transactions: status %d, %v", status, reply)
+	}
+	transactions, _ := reply["transactions"].([]interface{})
+	if len(transactions) != 1 {
+		t.Fatalf("transactions: %v, want the deposit", reply)
+	}
+	deposit := transactions[0].(map[string]interface{})
+	if deposit["type"] != "0" || deposit["status"] != "1" || deposit["amount"] != ether(1).String() {
+		t.Errorf("transactions: %v, want a settled recharge of %s", deposit, ether(1))
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	e := newTestEnv(t)
+	token, address := e.register("alice")
+	e.deposit(address, ether(1))
+
+	destination := crypto.PubkeyToAddress(e.payer.PublicKey).Hex()
+
+	status, _ := e.call(http.MethodPost, "/withdraw", "", map[string]string{"to": destination, "value": "1"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("withdraw without a token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	status, _ = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": "one"})
+	if status != http.StatusBadRequest {
+		t.Errorf("withdraw an invalid value: status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	status, reply := e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": "nowhere", "value": "1"})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(reply["error"].(string), "invalid address") {
+		t.Errorf("withdraw to an invalid address: status %d, %v, want %d", status, reply, http.StatusUnprocessableEntity)
+	}
+
+	status, reply = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": "1"})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(reply["error"].(string), "not a whitelisted") {
+		t.Errorf("withdraw to an address off the whitelist: status %d, %v, want %d", status, reply, http.StatusUnprocessableEntity)
+	}
+
+	status, reply = e.call(http.MethodPost, "/whitelist/add", token, map[string]string{"address": destination, "label": "payer"})
+	if status != http.StatusOK {
+		t.Fatalf("whitelist add: status %d, %v", status, reply)
+	}
+
+	status, reply = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": ether(2).String()})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(reply["error"].(string), "not enough") {
+		t.Errorf("withdraw more than the balance: status %d, %v, want %d", status, reply, http.StatusUnprocessableEntity)
+	}
+
+	half := new(big.Int).Div(ether(1), big.NewInt(2))
+	status, reply = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": half.String()})
+	if status != http.StatusOK {
+		t.Fatalf("withdraw: status %d, %v", status, reply)
+	}
+	hash, _ := reply["hash"].(string)
+	if hash == "" {
+		t.Fatalf("withdraw: %v, want a transaction hash", reply)
+	}
+
+	e.sim.Commit()
+	receipt, err := e.client.TransactionReceipt(context.Background(), common.HexToHash(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Errorf("withdrawal %s reverted", hash)
+	}
+
+	status, reply = e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("balance: status %d, %v", status, reply)
+	}
+	if reply["balance"] != half.String() {
+		t.Errorf("balance after withdrawal: %v, want %s", reply["balance"], half)
+	}
+}
+
+func TestWithdrawApproval(t *testing.T) {
+	e := newTestEnv(t)
+	config.ApprovalThreshold = "100000000000000000"
+	token, address := e.register("alice")
+	e.deposit(address, ether(1))
+
+	destination := crypto.PubkeyToAddress(e.payer.PublicKey).Hex()
+	half := new(big.Int).Div(ether(1), big.NewInt(2))
+
+	status, reply := e.call(http.MethodPost, "/whitelist/add", token, map[string]string{"address": destination, "label": "payer"})
+	if status != http.StatusOK {
+		t.Fatalf("whitelist add: status %d, %v", status, reply)
+	}
+
+	status, reply = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": half.String()})
+	if status != http.StatusAccepted {
+		t.Fatalf("withdraw above the threshold: status %d, %v, want %d", status, reply, http.StatusAccepted)
+	}
+	request, _ := reply["request"].(map[string]interface{})
+	if request["status"] != "0" {
+		t.Fatalf("withdraw above the threshold: %v, want a pending request", reply)
+	}
+
+	// the pending request reserves its value
+	status, reply = e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusOK || reply["balance"] != half.String() {
+		t.Errorf("balance with a pending request: status %d, %v, want %s", status, reply, half)
+	}
+
+	status, _ = e.call(http.MethodPost, "/admin/approve", token, map[string]interface{}{"id": request["id"]})
+	if status != http.StatusForbidden {
+		t.Errorf("approve as a user: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	operator := e.adminLogin("dave", "operator")
+	status, reply = e.call(http.MethodPost, "/admin/approve", operator, map[string]interface{}{"id": request["id"]})
+	if status != http.StatusOK {
+		t.Fatalf("approve: status %d, %v", status, reply)
+	}
+	request, _ = reply["request"].(map[string]interface{})
+	hash, _ := request["hash"].(string)
+	if request["status"] != "1" || hash == "" {
+		t.Fatalf("approve: %v, want a sent request", request)
+	}
+
+	e.sim.Commit()
+	receipt, err := e.client.TransactionReceipt(context.Background(), common.HexToHash(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Errorf("withdrawal %s reverted", hash)
+	}
+
+	status, reply = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": ether(1).String()})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("withdraw more than the balance left: status %d, %v, want %d", status, reply, http.StatusUnprocessableEntity)
+	}
+	// a rejected request releases its reservation
+	quarter := new(big.Int).Div(half, big.NewInt(2))
+	status, reply = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": quarter.String()})
+	if status != http.StatusAccepted {
+		t.Fatalf("withdraw above the threshold: status %d, %v, want %d", status, reply, http.StatusAccepted)
+	}
+	request, _ = reply["request"].(map[string]interface{})
+
+	status, reply = e.call(http.MethodPost, "/admin/reject", operator, map[string]interface{}{"id": request["id"], "reason": "unknown destination"})
+	if status != http.StatusOK {
+		t.Fatalf("reject: status %d, %v", status, reply)
+	}
+
+	status, reply = e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusOK || reply["balance"] != half.String() {
+		t.Errorf("balance after approval and rejection: status %d, %v, want %s", status, reply, half)
+	}
+
+	// an approved request that failed to send keeps its reservation until it is rejected
+	keys = nil
+	status, reply = e.call(http.MethodPost, "/withdraw", token, map[string]string{"to": destination, "value": quarter.String()})
+	if status != http.StatusAccepted {
+		t.Fatalf("withdraw above the threshold: status %d, %v, want %d", status, reply, http.StatusAccepted)
+	}
+	request, _ = reply["request"].(map[string]interface{})
+
+	status, reply = e.call(http.MethodPost, "/admin/approve", operator, map[string]interface{}{"id": request["id"]})
+	if status != http.StatusUnprocessableEntity || !strings.Contains(reply["error"].(string), "fail to send") {
+		t.Fatalf("approve without the hot wallet key: status %d, %v, want %d", status, reply, http.StatusUnprocessableEntity)
+	}
+
+	status, reply = e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusOK || reply["balance"] != quarter.String() {
+		t.Errorf("balance with a request that failed to send: status %d, %v, want %s", status, reply, quarter)
+	}
+
+	status, reply = e.call(http.MethodPost, "/admin/reject", operator, map[string]interface{}{"id": request["id"], "reason": "sent by hand"})
+	if status != http.StatusOK {
+		t.Fatalf("reject a request that failed to send: status %d, %v", status, reply)
+	}
+
+	status, reply = e.call(http.MethodGet, "/balance", token, nil)
+	if status != http.StatusOK || reply["balance"] != half.String() {
+		t.Errorf("balance after rejecting a request that failed to send: status %d, %v, want %s", status, reply, half)
+	}
+}
+
+func TestAdminCentralize(t *testing.T) {
+	e := newTestEnv(t)
+	token, address := e.register("alice")
+	e.deposit(address, ether(1))
+
+	status, _ := e.call(http.MethodPost, "/admin/centralize", "", map[string]string{})
+	if status != http.StatusUnauthorized {
+		t.Errorf("centralize without a token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	status, _ = e.call(http.MethodPost, "/admin/centralize", token, map[string]string{})
+	if status != http.StatusForbidden {
+		t.Errorf("centralize as a user: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	auditor := e.adminLogin("carol", "auditor")
+	status, _ = e.call(http.MethodPost, "/admin/centralize", auditor, map[string]string{})
+	if status != http.StatusForbidden {
+		t.Errorf("centralize as an auditor: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	// sweeps only read balances settleconfirmations blocks deep
+	e.sim.Commit()
+
+	operator := e.adminLogin("dave", "operator")
+	status, reply := e.call(http.MethodPost, "/admin/centralize", operator, map[string]string{})
+	if status != http.StatusOK {
+		t.Fatalf("centralize as an operator: status %d, %v", status, reply)
+	}
+
+	job, _ := reply["job"].(map[string]interface{})
+	items, _ := job["items"].([]interface{})
+	if len(items) != 1 {
+		t.Fatalf("centralize: %v, want one item", job)
+	}
+	item := items[0].(map[string]interface{})
+	if !strings.EqualFold(item["address"].(string), address) || item["state"] != "broadcast" {
+		t.Errorf("centralize: %v, want a broadcast sweep of %s", item, address)
+	}
+
+	before, err := e.client.BalanceAt(context.Background(), common.HexToAddress(config.MainAddress), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.sim.Commit()
+	after, err := e.client.BalanceAt(context.Background(), common.HexToAddress(config.MainAddress), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Cmp(before) <= 0 {
+		t.Errorf("hot wallet holds %s after centralize, %s before", after, before)
+	}
+}
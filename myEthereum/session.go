@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session : a logged in user or admin, identified by its token
+// role
+//  user: acts on the ledger of Address
+//  operator, auditor, superadmin: the role of the admin Name, see permissions
+type Session struct {
+	Token   string `json:"token"`
+	Address string `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Role    string `json:"role"`
+	Expires int64  `json:"expires"`
+}
+
+// userlocks : serializes balance checks and withdrawals per user address
+var userlocks sync.Map
+
+// NewSession : create and save a session for the user address or the admin name with role,
+// valid for SessionTTL
+func NewSession(address, name, role string) (*Session, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, errors.New("fail to create session: " + err.Error())
+	}
+
+	session := Session{
+		Token:   hex.EncodeToString(buf),
+		Address: strings.ToLower(address),
+		Name:    name,
+		Role:    role,
+		Expires: time.Now().Add(SessionTTL).Unix(),
+	}
+
+	err := store.Update(func(tx StorageTx) error {
+		return tx.Put(BucketSessions, session.Token, &session)
+	})
+	if err != nil {
+		return nil, errors.New("fail to save session: " + err.Error())
+	}
+
+	return &session, nil
+}
+
+// GetSession : returns the session of token, an expired session is removed
+func GetSession(token string) (*Session, error) {
+	if token == "" {
+		return nil, errors.New("not logged in")
+	}
+
+	var session Session
+	found, expired := false, false
+	err := store.Update(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketSessions, token, &session)
+		if err != nil || !found {
+			return err
+		}
+
+		// an error would roll back the delete, so expiry is reported after the update
+		if time.Now().Unix() > session.Expires {
+			expired = true
+			return tx.Delete(BucketSessions, token)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open session: " + err.Error())
+	}
+	if !found {
+		return nil, errors.New("not logged in")
+	}
+	if expired {
+		return nil, errors.New("session expired")
+	}
+
+	return &session, nil
+}
+
+// EndSession : remove the session of token
+func EndSession(token string) error {
+	return store.Update(func(tx StorageTx) error {
+		return tx.Delete(BucketSessions, token)
+	})
+}
+
+// Valid : returns an error unless the session still exists and has role
+func (s *Session) Valid(role string) error {
+	if s == nil {
+		return errors.New("not logged in")
+	}
+
+	current, err := GetSession(s.Token)
+	if err != nil {
+		return err
+	}
+	if current.Role != role {
+		return errors.New("permission denied")
+	}
+
+	return nil
+}
+
+// LockUser : wait until no other withdrawal of address is running, returns the unlock function
+func LockUser(address string) func() {
+	lock, _ := userlocks.LoadOrStore(strings.ToLower(address), &sync.Mutex{})
+	mutex := lock.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
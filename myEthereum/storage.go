@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// BucketAccounts : the bucket storing the account pool, keyed by address
+	BucketAccounts = "accounts"
+	// BucketAccountInfo : the bucket storing users' ledgers, keyed by address
+	BucketAccountInfo = "accountinfo"
+	// BucketMeta : the bucket storing system state such as the deposit scan cursor
+	BucketMeta = "meta"
+	// BucketNonces : the bucket storing the nonces reserved per sender, keyed by address
+	BucketNonces = "nonces"
+	// BucketJournal : the bucket storing the accounting journal, keyed by entry id
+	BucketJournal = "journal"
+	// BucketSessions : the bucket storing login sessions, keyed by token
+	BucketSessions = "sessions"
+	// BucketAdmins : the bucket storing admin accounts, keyed by name
+	BucketAdmins = "admins"
+	// BucketAudit : the bucket storing the audit log of admin actions, keyed by entry id
+	BucketAudit = "audit"
+	// BucketUsers : the bucket storing users registered by name, keyed by name,
+	// its sequence is the next derivation index
+	BucketUsers = "users"
+	// BucketWithdrawRequests : the bucket storing withdrawals waiting for approval, keyed by request id
+	BucketWithdrawRequests = "withdrawrequests"
+	// BucketWhitelist : the bucket storing users' withdrawal addresses, keyed by user address and withdrawal address
+	BucketWhitelist = "whitelist"
+	// BucketLimitOverrides : the bucket storing admins' waivers of the withdrawal limits, keyed by user address
+	BucketLimitOverrides = "limitoverrides"
+	// BucketCentralizeJobs : the bucket storing centralize runs and the state of each address, keyed by job id
+	BucketCentralizeJobs = "centralizejobs"
+	// BucketExported : the bucket storing the transactions exported for offline signing until they are imported,
+	// keyed by sender and nonce
+	BucketExported = "exported"
+	// BucketBalances : the bucket storing the running balance of each ledger account of the journal, keyed by account
+	BucketBalances = "balances"
+)
+
+const (
+	// MetaScanCursor : the key of the deposit scan cursor in BucketMeta
+	MetaScanCursor = "scancursor"
+	// MetaRefillRequest : the key of the outstanding refill of the hot wallet in BucketMeta
+	MetaRefillRequest = "refillrequest"
+	// MetaJournalIndex : the key of the last journal entry applied to BucketBalances in BucketMeta
+	MetaJournalIndex = "journalindex"
+)
+
+// Storage : a transactional store holding all the system data
+type Storage interface {
+	// View runs fn in a read-only transaction
+	View(fn func(tx StorageTx) error) error
+	// Update runs fn in a read-write transaction, which is committed
+	// only if fn returns nil
+	Update(fn func(tx StorageTx) error) error
+	// Close releases the store
+	Close() error
+}
+
+// StorageTx : the operations available inside a storage transaction,
+// values are stored as json
+type StorageTx interface {
+	// Get decodes the value under key into value, returns false if the key does not exist
+	Get(bucket, key string, value interface{}) (bool, error)
+	// Put encodes value and stores it under key
+	Put(bucket, key string, value interface{}) error
+	// Delete removes key from bucket
+	Delete(bucket, key string) error
+	// Keys returns all the keys in bucket in byte order
+	Keys(bucket string) ([]string, error)
+	// NextID returns the next value of the bucket's sequence, starting at 1
+	NextID(bucket string) (uint64, error)
+}
+
+// boltStorage : a Storage backed by an embedded bbolt database
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// boltTx : a StorageTx backed by a bbolt transaction
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// OpenBoltStorage : open or create the bbolt database at path
+func OpenBoltStorage(path string) (Storage, error) {
+	// bbolt locks the file, so a second session fails instead of overwriting the ledger
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errors.New("fail to open storage: it is in use by another session")
+	}
+	if err != nil {
+		return nil, errors.New("fail to open storage: " + err.Error())
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) View(fn func(tx StorageTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStorage) Update(fn func(tx StorageTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (t *boltTx) Get(bucket, key string, value interface{}) (bool, error) {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return false, nil
+	}
+
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+
+	err := json.Unmarshal(data, value)
+	if err != nil {
+		return false, errors.New("fail to decode " + bucket + "/" + key + ": " + err.Error())
+	}
+
+	return true, nil
+}
+
+func (t *boltTx) Put(bucket, key string, value interface{}) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errors.New("fail to encode " + bucket + "/" + key + ": " + err.Error())
+	}
+
+	return b.Put([]byte(key), data)
+}
+
+func (t *boltTx) Delete(bucket, key string) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Delete([]byte(key))
+}
+
+func (t *boltTx) Keys(bucket string) ([]string, error) {
+	keys := []string{}
+
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return keys, nil
+	}
+
+	err := b.ForEach(func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+
+	return keys, err
+}
+
+func (t *boltTx) NextID(bucket string) (uint64, error) {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return 0, err
+	}
+
+	return b.NextSequence()
+}
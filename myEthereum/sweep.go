@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// SweepItem : what a centralize job does with one deposit address
+// action, set once the transaction is planned
+//  swept: the ether is sent to the hot wallet
+//  token: a token balance is sent to the hot wallet, the ether follows on a later run
+//  funded: the gas station sends the gas of a token sweep, which follows on a later run
+// state
+//  planned: nothing is signed yet
+//  signed: Tx is signed and about to be broadcast, a resumed job broadcasts it again
+//  broadcast: Tx is sent and saved to the ledger
+//  confirmed: Tx is settled
+//  failed: Error says why, a resumed job plans the address again
+//  skipped: there is nothing to send, Reason says why
+type SweepItem struct {
+	Address string      `json:"address"`
+	State   string      `json:"state"`
+	Action  string      `json:"action,omitempty"`
+	Amount  string      `json:"amount,omitempty"`
+	Token   string      `json:"token,omitempty"`
+	Tx      *UnsignedTx `json:"tx,omitempty"`
+	Reason  string      `json:"reason,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// planSweep : plan the next transaction of a deposit address, one token balance first, or its ether
+// once no token balance is left, the item has a reserved nonce unless it is skipped
+func planSweep(client *ethclient.Client, address string, block *big.Int) (*SweepItem, error) {
+	item := SweepItem{Address: strings.ToLower(address), State: "skipped"}
+
+	// the balances below do not account for transactions in flight
+	pending, err := hasPendingSweep(address)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		item.Reason = "a sweep of this address is pending"
+		return &item, nil
+	}
+
+	for _, token := range config.Tokens {
+		balance, err := TokenBalance(client, token, address, block)
+		if err != nil {
+			return nil, err
+		}
+		if balance.Sign() > 0 {
+			return planTokenSweep(client, address, token, balance, block)
+		}
+	}
+
+	unsigned, reason, err := buildSweep(client, address, block)
+	if err != nil {
+		return nil, err
+	}
+	if unsigned == nil {
+		item.Reason = reason
+		return &item, nil
+	}
+
+	item.State = "planned"
+	item.Action = "swept"
+	item.Amount = unsigned.Value
+	item.Tx = unsigned
+	return &item, nil
+}
+
+// buildSweep : returns the transaction sending the ether of address at block to the hot wallet, less the most
+// it can pay in gas, or nil and the reason if that is nothing or below the sweep minimum
+func buildSweep(client *ethclient.Client, address string, block *big.Int) (*UnsignedTx, string, error) {
+	balance, err := client.BalanceAt(context.Background(), common.HexToAddress(address), block)
+	if err != nil {
+		return nil, "", errors.New("fail to get balance: " + err.Error())
+	}
+	if balance.Sign() == 0 {
+		return nil, "the address is empty", nil
+	}
+
+	minimum, err := config.SweepThreshold()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the gas of a plain transfer does not depend on its value
+	unsigned, err := BuildTransaction(client, new(big.Int), address, config.MainAddress, "2")
+	if err != nil {
+		return nil, "", errors.New("fail to build sweep: " + err.Error())
+	}
+
+	maxfee, err := unsigned.MaxFee()
+	if err != nil {
+		ReleaseNonce(unsigned.From, unsigned.Nonce)
+		return nil, "", err
+	}
+
+	value := new(big.Int).Sub(balance, maxfee)
+	switch {
+	case value.Sign() <= 0:
+		ReleaseNonce(unsigned.From, unsigned.Nonce)
+		return nil, fmt.Sprintf("the balance %s does not cover the gas of %s", balance, maxfee), nil
+	case minimum != nil && value.Cmp(minimum) < 0:
+		ReleaseNonce(unsigned.From, unsigned.Nonce)
+		return nil, fmt.Sprintf("%s after gas is below the sweep minimum %s", value, minimum), nil
+	}
+
+	unsigned.Value = value.String()
+	unsigned.Ledger = strings.ToLower(address)
+	return unsigned, "", nil
+}
+
+// planTokenSweep : plan sending the token balance of address to the hot wallet, or the gas station
+// sending address the gas for it first, the ether is read at block as the token balance is
+func planTokenSweep(client *ethclient.Client, address, token string, balance, block *big.Int) (*SweepItem, error) {
+	item := SweepItem{Address: strings.ToLower(address), State: "planned", Action: "token", Amount: balance.String(), Token: strings.ToLower(token)}
+
+	unsigned, err := BuildCall(client, new(big.Int), address, token, "2", TransferData(config.MainAddress, balance))
+	if err != nil {
+		return nil, errors.New("fail to build token sweep: " + err.Error())
+	}
+	unsigned.Ledger = strings.ToLower(address)
+
+	maxfee, err := unsigned.MaxFee()
+	if err != nil {
+		ReleaseNonce(unsigned.From, unsigned.Nonce)
+		return nil, err
+	}
+
+	ether, err := client.BalanceAt(context.Background(), common.HexToAddress(address), block)
+	if err != nil {
+		ReleaseNonce(unsigned.From, unsigned.Nonce)
+		return nil, errors.New("fail to get balance: " + err.Error())
+	}
+
+	if ether.Cmp(maxfee) >= 0 {
+		item.Tx = unsigned
+		return &item, nil
+	}
+
+	// the address cannot pay the gas of the token transfer
+	ReleaseNonce(unsigned.From, unsigned.Nonce)
+	shortfall := new(big.Int).Sub(maxfee, ether)
+	if config.GasStation == "" {
+		item.State = "skipped"
+		item.Reason = "the address lacks " + shortfall.String() + " for the gas of the token sweep and no gas station is configured"
+		return &item, nil
+	}
+
+	funding, err := BuildTransaction(client, shortfall, config.GasStation, address, "5")
+	if err != nil {
+		return nil, errors.New("fail to build gas funding: " + err.Error())
+	}
+	funding.Ledger = strings.ToLower(address)
+
+	item.Action = "funded"
+	item.Amount = shortfall.String()
+	item.Tx = funding
+	return &item, nil
+}
+
+// hasPendingSweep : returns true if a sweep of address or a gas funding to it is not settled yet
+func hasPendingSweep(address string) (bool, error) {
+	pending := false
+	err := store.View(func(tx StorageTx) error {
+		info, err := GetAccountInfo(tx, address)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range info.Transactions {
+			if t.Status == "0" && (t.Type == "2" || t.Type == "5") {
+				pending = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, errors.New("fail to open account info: " + err.Error())
+	}
+
+	return pending, nil
+}
+
+// FormatSweepItem : returns what a centralize job did with an address as one line
+func FormatSweepItem(item SweepItem) string {
+	line := fmt.Sprintf("[%s] %s", item.Address, item.State)
+	switch item.Action {
+	case "swept":
+		line += " sweep of " + item.Amount
+	case "token":
+		line += " sweep of " + item.Amount + " of token " + item.Token
+	case "funded":
+		line += " gas funding of " + item.Amount + " for token " + item.Token
+	}
+
+	if item.Tx != nil && item.Tx.Hash != "" {
+		line += ": " + item.Tx.Hash
+	}
+	switch {
+	case item.Error != "":
+		line += ": " + item.Error
+	case item.Reason != "":
+		line += ": " + item.Reason
+	}
+
+	return line
+}
+
+// confirmedHead : returns the latest block deep enough to be both credited and settled,
+// sweeps leave what arrived after it to the next centralize, so a sweep never moves
+// funds the deposit scan has not credited or a withdrawal that may still be reorged
+func confirmedHead(client *ethclient.Client) (*big.Int, error) {
+	head, err := client.BlockNumber(context.Background())
+	if err != nil {
+		return nil, errors.New("fail to get block number: " + err.Error())
+	}
+
+	depth := uint64(config.DepositConfirmations)
+	if settle := uint64(config.SettleConfirmations); settle > depth {
+		depth = settle
+	}
+	if head < depth {
+		return new(big.Int), nil
+	}
+
+	return new(big.Int).SetUint64(head - depth), nil
+}
@@ -3,297 +3,426 @@ package main
 import (
 	"context"
 	"crypto/ecdsa"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
-	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
-	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
-	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/bcrypt"
 )
 
-// GenerateAccount : returns the mnemontic of the user
-func GenerateAccount() (*string, error) {
-	// generate a new mnemonic
-	entropy, err := bip39.NewEntropy(256)
-	if err != nil {
-		return nil, errors.New("fail to generate mnemonic:" + err.Error())
+// RegisterAnAccount : register name with password and assign it the next deposit address
+// derived from the master seed, returns the address
+func RegisterAnAccount(name, password string) (*string, error) {
+	if name == "" {
+		return nil, errors.New("user name is empty")
+	}
+	if len(password) < 8 {
+		return nil, errors.New("password must have at least 8 characters")
 	}
 
-	mnemonic, err := bip39.NewMnemonic(entropy)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return nil, errors.New("fail to generate mnemonic:" + err.Error())
+		return nil, errors.New("fail to hash password: " + err.Error())
 	}
 
-	// generate a wallet
-	wallet, err := hdwallet.NewFromMnemonic(mnemonic)
+	var address string
+	err = store.Update(func(tx StorageTx) error {
+		var existing User
+		found, err := tx.Get(BucketUsers, name, &existing)
+		if err != nil {
+			return err
+		}
+		if found {
+			return errors.New("user " + name + " already exists")
+		}
+
+		// the sequence only moves forward, so an index is never handed out twice
+		id, err := tx.NextID(BucketUsers)
+		if err != nil {
+			return err
+		}
+		index := id - 1
+
+		address, err = DeriveAddress(index)
+		if err != nil {
+			return err
+		}
+
+		err = PutPoolAccount(tx, &PoolAccount{Address: address, Status: "1", Derived: true, Index: index})
+		if err != nil {
+			return err
+		}
+
+		return tx.Put(BucketUsers, name, &User{Name: name, PasswordHash: string(hash), Address: address, Index: index})
+	})
 	if err != nil {
-		return nil, errors.New("fail to generate account:" + err.Error())
+		return nil, errors.New("fail to register: " + err.Error())
 	}
 
-	path := hdwallet.MustParseDerivationPath("m/44'/60'/0'/0/0")
-	account, err := wallet.Derive(path, false)
+	return &address, nil
+}
+
+// LoginAnAccount : log in an account of the legacy pool by its mnemonic, returns a session scoped to its address
+func LoginAnAccount(mnemonic string) (*Session, error) {
+	// get address
+	address, err := MnemonicToAccount(mnemonic)
 	if err != nil {
-		return nil, errors.New("fail to generate account:" + err.Error())
+		return nil, errors.New("wrong mnemonic")
 	}
 
-	// store key
-	ks := keystore.NewKeyStore("../data/keystore", keystore.StandardScryptN, keystore.StandardScryptP)
+	// only addresses handed out by the pool have a ledger
+	assigned := false
+	err = store.View(func(tx StorageTx) error {
+		accounts, err := GetPoolAccounts(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, account := range accounts {
+			if account.Status == "1" && strings.EqualFold(account.Address, *address) {
+				assigned = true
+			}
+		}
 
-	privateKey, err := wallet.PrivateKey(account)
+		return nil
+	})
 	if err != nil {
-		return nil, errors.New("fail to generate account:" + err.Error())
+		return nil, errors.New("fail to open account pool: " + err.Error())
+	}
+	if !assigned {
+		return nil, errors.New("wrong mnemonic")
 	}
 
-	_, err = ks.ImportECDSA(privateKey, "admin")
+	return NewSession(*address, "", "user")
+}
+
+// LoginUser : log in a user registered by name, returns a session scoped to the user's address
+func LoginUser(name, password string) (*Session, error) {
+	var user User
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketUsers, name, &user)
+		return err
+	})
 	if err != nil {
-		return nil, errors.New("fail to generate account:" + err.Error())
+		return nil, errors.New("fail to open users: " + err.Error())
 	}
 
-	return &mnemonic, nil
+	// the same answer for unknown names and wrong passwords
+	if !found || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, errors.New("wrong name or password")
+	}
+
+	return NewSession(user.Address, user.Name, "user")
 }
 
-// RegisterAnAccount : returns the address and mnemonic of an available account
-func RegisterAnAccount() (*string, *string, error) {
-	// open pool file
-	accountdataptr, err := ReadFileContent(AcountPoolPath)
+// RefreshAccountInfo : settle pending transactions by receipt and update the user's ledger
+// returns pending balance
+// the node is asked outside the write transaction, so a slow node does not hold up other writers,
+// and a transaction another refresh has changed meanwhile is left to it
+func RefreshAccountInfo(client *ethclient.Client, address string) (*string, *string, error) {
+	// read ledger
+	var snapshot *AccountInfo
+	err := store.View(func(stx StorageTx) error {
+		var err error
+		snapshot, err = GetAccountInfo(stx, address)
+		return err
+	})
 	if err != nil {
-		return nil, nil, errors.New("fail to open account pool file: " + err.Error())
+		return nil, nil, errors.New("fail to open account info: " + err.Error())
 	}
 
-	accountdata := *accountdataptr
-
-	accounts, ok := accountdata["accounts"].([]interface{})
-	if !ok {
-		return nil, nil, errors.New("fail to open account pool file")
+	changes, err := settleTransactions(client, snapshot.Transactions)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// get an available address
-	var tgaddress, tgmnemonic string
-	newaccounts := []interface{}{}
-	found := false
-	for _, v := range accounts {
-		account, ok := v.(map[string]interface{})
-		if !ok {
-			return nil, nil, errors.New("fail to open account pool file")
+	var adbl, pbl string
+	err = store.Update(func(stx StorageTx) error {
+		info, err := GetAccountInfo(stx, address)
+		if err != nil {
+			return errors.New("fail to open account info: " + err.Error())
 		}
 
-		if account["status"] == "0" && !found {
-			found = true
-			account["status"] = "1"
-			tgaddress, _ = account["address"].(string)
-			tgmnemonic, _ = account["mnemonic"].(string)
+		// carry balances from before the journal over to it
+		err = OpenJournal(stx, address, info)
+		if err != nil {
+			return errors.New("fail to open journal: " + err.Error())
 		}
 
-		newaccounts = append(newaccounts, account)
-	}
+		for i := range info.Transactions {
+			tx := &info.Transactions[i]
+			change, ok := changes[tx.Hash]
+			if !ok || tx.Status != change.before {
+				continue
+			}
 
-	if !found {
-		return nil, nil, errors.New("no available account")
-	}
+			// take back a transaction whose block is no longer canonical
+			if tx.Status == "1" || tx.Status == "2" {
+				err = PostTransaction(stx, address, tx, true)
+				if err != nil {
+					return errors.New("fail to post transaction: " + err.Error())
+				}
+			}
 
-	accountdata["accounts"] = newaccounts
+			// a replacement may have been linked meanwhile
+			replacedby := tx.ReplacedBy
+			*tx = change.tx
+			tx.ReplacedBy = replacedby
 
-	newaccountdata, err := json.MarshalIndent(accountdata, "", "")
-	if err != nil {
-		return nil, nil, errors.New("fail to write account pool file")
-	}
+			// a successful transaction moves value, a failed one only pays its fee
+			if tx.Status == "1" || tx.Status == "2" {
+				err = PostTransaction(stx, address, tx, false)
+				if err != nil {
+					return errors.New("fail to post transaction: " + err.Error())
+				}
+			}
+		}
 
-	// rewrite account info
-	file, err := os.Create(AcountPoolPath)
-	if err != nil {
-		return nil, nil, errors.New("fail to write account pool file: " + err.Error())
-	}
+		// save new ledger, pending withdrawals are not available to the user
+		err = SyncBalances(stx, address, info)
+		if err != nil {
+			return errors.New("fail to get balance: " + err.Error())
+		}
 
-	defer file.Close()
+		err = PutAccountInfo(stx, address, info)
+		if err != nil {
+			return errors.New("fail to write account info: " + err.Error())
+		}
 
-	_, err = file.WriteString(string(newaccountdata))
+		adbl = info.AddrBalance
+		pbl = info.PendingBalance
+		return nil
+	})
 	if err != nil {
-		return nil, nil, errors.New("fail to write account pool file: " + err.Error())
+		return nil, nil, err
 	}
 
-	return &tgaddress, &tgmnemonic, nil
+	return &adbl, &pbl, nil
 }
 
-// LoginAnAccount : log in the system
-func LoginAnAccount(mnemonic string) bool {
-	// get address
-	address, err := MnemonicToAccount(mnemonic)
-	if err != nil {
-		return false
-	}
-
-	curuser = strings.ToLower(*address)
-	return true
+// txChange : the new state of a ledger transaction, applied only if its status is still before
+type txChange struct {
+	before string
+	tx     MyTransaction
 }
 
-// RefreshAccountInfo : monitor transactions by hash and update current user's information file
-// returns pending balance
-func RefreshAccountInfo(client *ethclient.Client, address string) (*string, *string, error) {
-	// read info file content
-	dataptr, err := ReadFileContent(AccountInfoPath + address + ".txt")
+// settleTransactions : returns the changes the chain makes to transactions by hash, rolling back those
+// whose block was reorganized away and settling the pending ones by receipt
+func settleTransactions(client *ethclient.Client, transactions []MyTransaction) (map[string]txChange, error) {
+	txs := append([]MyTransaction{}, transactions...)
+
+	head, err := client.BlockNumber(context.Background())
 	if err != nil {
-		return nil, nil, errors.New("fail to open account info file: " + err.Error())
+		return nil, errors.New("fail to get block number: " + err.Error())
 	}
 
-	data := *dataptr
+	// take back transactions whose block is no longer canonical, they are settled again below
+	reorged := make(map[string]bool)
+	for i := range txs {
+		tx := &txs[i]
+		if tx.Status != "1" && tx.Status != "2" {
+			continue
+		}
 
-	// get balance, addrbalance and transactions
-	var balance, addrbalance, pendingbalance *big.Int
-	if value, ok := data["balance"].(string); ok {
-		balance = new(big.Int)
-		balance, _ = balance.SetString(value, 10)
-	}
-	if value, ok := data["addrbalance"].(string); ok {
-		addrbalance = new(big.Int)
-		addrbalance, _ = addrbalance.SetString(value, 10)
-	}
-	if value, ok := data["pendingbalance"].(string); ok {
-		pendingbalance = new(big.Int)
-		pendingbalance, _ = pendingbalance.SetString(value, 10)
-	}
-	var transactions []interface{}
-	if value, ok := data["transactions"].([]interface{}); ok {
-		transactions = value
+		canonical, err := IsCanonical(client, tx, head)
+		if err != nil {
+			return nil, errors.New("fail to check block: " + err.Error())
+		}
+		if canonical {
+			continue
+		}
+
+		tx.Status = "0"
+		tx.BlockNumber = 0
+		tx.BlockHash = ""
+		tx.GasUsed = 0
+		tx.EffectiveGasPrice = ""
+		tx.Fee = ""
+		reorged[NonceKey(tx)] = true
 	}
 
-	// check all transaction by hash and refresh account info
-	var newtransactions []interface{}
-	haspending := false
-	for _, t := range transactions {
-		txmap, _ := t.(map[string]interface{})
-		tx, err := MapToTransaction(txmap)
-		if err != nil {
-			return nil, nil, errors.New("fail to get transaction: " + err.Error())
+	// any transaction sharing a reorganized nonce may be mined instead
+	for i := range txs {
+		tx := &txs[i]
+		if tx.Status == "4" && reorged[NonceKey(tx)] {
+			tx.Status = "0"
 		}
+	}
+
+	// check all transaction receipts
+	mined := make(map[string]bool)
+	for i := range txs {
+		tx := &txs[i]
 
 		if tx.Status == "0" {
-			// get transaction by hash
-			txHash := common.HexToHash(tx.Hash)
-			_, ispending, err := client.TransactionByHash(context.Background(), txHash)
+			err = SettleTransaction(client, tx, head)
 			if err != nil {
-				return nil, nil, errors.New("fail to get transaction: " + err.Error())
+				return nil, errors.New("fail to get transaction: " + err.Error())
 			}
+		}
 
-			// refresh transaction status
-			if !ispending {
-				tx.Status = "1"
-				switch tx.Type {
-				case "0":
-					amount := new(big.Int)
-					amount, ok := amount.SetString(tx.Amount, 10)
-					if !ok {
-						return nil, nil, errors.New("fail to get amount")
-					}
-					balance.Add(balance, amount)
-					addrbalance.Add(addrbalance, amount)
-				case "1":
-					amount := new(big.Int)
-					amount, ok := amount.SetString(tx.Amount, 10)
-					if !ok {
-						return nil, nil, errors.New("fail to get amount")
-					}
-					balance.Sub(balance, amount)
-					addrbalance.Sub(addrbalance, amount)
-				case "2":
-					amount := new(big.Int)
-					amount, ok := amount.SetString(tx.Amount, 10)
-					if !ok {
-						return nil, nil, errors.New("fail to get amount")
-					}
-					addrbalance.Sub(addrbalance, amount)
-				}
-			} else {
-				haspending = true
-				if tx.Type == "1" {
-					amount := new(big.Int)
-					amount, ok := amount.SetString(tx.Amount, 10)
-					if !ok {
-						return nil, nil, errors.New("fail to get amount")
-					}
-					pendingbalance = pendingbalance.Sub(balance, amount)
-				}
-			}
-			newtransactions = append(newtransactions, TransactionToMap(tx))
-		} else {
-			newtransactions = append(newtransactions, txmap)
+		if tx.Status == "1" || tx.Status == "2" {
+			mined[NonceKey(tx)] = true
 		}
 	}
 
-	// sychronize balance and pending balance
-	if !haspending {
-		pendingbalance = balance
+	// a nonce is mined only once, the other transactions sharing it were replaced
+	for i := range txs {
+		tx := &txs[i]
+		if (tx.Status == "0" || tx.Status == "3") && mined[NonceKey(tx)] {
+			tx.Status = "4"
+		}
+	}
+
+	changes := make(map[string]txChange)
+	for i := range txs {
+		if txs[i] != transactions[i] {
+			changes[txs[i].Hash] = txChange{before: transactions[i].Status, tx: txs[i]}
+		}
 	}
 
-	// generate new info
-	newinfo := make(map[string]interface{})
-	newinfo["balance"] = balance.String()
-	newinfo["addrbalance"] = addrbalance.String()
-	newinfo["pendingbalance"] = pendingbalance.String()
-	newinfo["transactions"] = newtransactions
+	return changes, nil
+}
 
-	newinfodata, err := json.MarshalIndent(newinfo, "", "")
+// SettleTransaction : refresh the status of a pending transaction, which is settled
+// once its receipt is settleconfirmations blocks deep
+func SettleTransaction(client *ethclient.Client, tx *MyTransaction, head uint64) error {
+	txHash := common.HexToHash(tx.Hash)
+
+	receipt, err := client.TransactionReceipt(context.Background(), txHash)
+	if err == ethereum.NotFound {
+		// not mined yet, check if the node still knows it
+		_, _, err = client.TransactionByHash(context.Background(), txHash)
+		if err == ethereum.NotFound {
+			if time.Since(time.Unix(tx.Created, 0)) > DropTimeout {
+				tx.Status = "3"
+			}
+			return nil
+		}
+		return err
+	}
 	if err != nil {
-		return nil, nil, errors.New("fail to write user file")
+		return err
+	}
+
+	// wait for confirmations
+	if receipt.BlockNumber == nil || head+1 < receipt.BlockNumber.Uint64()+uint64(config.SettleConfirmations) {
+		return nil
 	}
 
-	// save new data
-	file, err := os.Create(AccountInfoPath + address + ".txt")
+	tx.BlockNumber = receipt.BlockNumber.Uint64()
+	tx.BlockHash = strings.ToLower(receipt.BlockHash.Hex())
+	tx.GasUsed = receipt.GasUsed
+
+	// record what the sender paid
+	price, err := PaidGasPrice(client, tx, receipt.BlockNumber)
 	if err != nil {
-		return nil, nil, errors.New("fail to write user file: " + err.Error())
+		return err
+	}
+	tx.EffectiveGasPrice = price.String()
+	tx.Fee = new(big.Int).Mul(price, new(big.Int).SetUint64(receipt.GasUsed)).String()
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		tx.Status = "2"
+		return nil
 	}
 
-	defer file.Close()
+	tx.Status = "1"
+	return nil
+}
+
+// PaidGasPrice : returns the gas price a transaction mined in block number paid,
+// a dynamic-fee transaction pays the base fee plus its tip, up to its fee cap
+func PaidGasPrice(client *ethclient.Client, tx *MyTransaction, number *big.Int) (*big.Int, error) {
+	if tx.GasFeeCap == "" {
+		if tx.GasPrice == "" {
+			// transactions saved before fees were recorded
+			return new(big.Int), nil
+		}
+		return ParseAmount(tx.GasPrice)
+	}
 
-	_, err = file.WriteString(string(newinfodata))
+	feeCap, err := ParseAmount(tx.GasFeeCap)
 	if err != nil {
-		return nil, nil, errors.New("fail to write userfile: " + err.Error())
+		return nil, err
+	}
+	tipCap, err := ParseAmount(tx.GasTipCap)
+	if err != nil {
+		return nil, err
 	}
 
-	adbl := addrbalance.String()
-	pbl := pendingbalance.String()
-	return &adbl, &pbl, nil
+	header, err := client.HeaderByNumber(context.Background(), number)
+	if err != nil {
+		return nil, err
+	}
+	if header.BaseFee == nil {
+		return feeCap, nil
+	}
+
+	price := new(big.Int).Add(header.BaseFee, tipCap)
+	if price.Cmp(feeCap) > 0 {
+		price = feeCap
+	}
+
+	return price, nil
 }
 
-// RefreshAllAccount : monitor transactions by hash and update all users' information file
-func RefreshAllAccount(client *ethclient.Client) (*[]map[string]string, bool) {
-	// open pool file
-	accountdataptr, err := ReadFileContent(AcountPoolPath)
+// IsCanonical : returns false if the block a settled transaction was mined in has been reorganized away
+func IsCanonical(client *ethclient.Client, tx *MyTransaction, head uint64) (bool, error) {
+	// transactions settled before blocks were recorded, and those deep enough, are final
+	if tx.BlockHash == "" || head > tx.BlockNumber+ReorgDepth {
+		return true, nil
+	}
+
+	header, err := client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(tx.BlockNumber))
+	if err == ethereum.NotFound {
+		return false, nil
+	}
 	if err != nil {
-		return nil, false
+		return false, err
 	}
 
-	accountdata := *accountdataptr
+	return strings.EqualFold(header.Hash().Hex(), tx.BlockHash), nil
+}
 
-	accounts, ok := accountdata["accounts"].([]interface{})
-	if !ok {
+// RefreshAllAccount : settle pending transactions by receipt and update all users' ledgers
+func RefreshAllAccount(client *ethclient.Client) (*[]map[string]string, bool) {
+	// read account pool
+	var accounts []PoolAccount
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		accounts, err = GetPoolAccounts(tx)
+		return err
+	})
+	if err != nil {
 		return nil, false
 	}
 
 	// calculate all the balance
 	info := []map[string]string{}
-	for _, v := range accounts {
+	for _, account := range accounts {
 		userinfo := make(map[string]string)
-		account, _ := v.(map[string]interface{})
 
-		if acctype, _ := account["status"].(string); acctype != "1" {
+		if account.Status != "1" {
 			continue
 		}
 
-		address, _ := account["address"].(string)
-
-		addressbalance, _, err := RefreshAccountInfo(client, address)
+		addressbalance, _, err := RefreshAccountInfo(client, account.Address)
 		if err != nil {
 			fmt.Println(err)
 			return nil, false
 		}
-		userinfo["address"] = address
+		userinfo["address"] = account.Address
 		userinfo["addressbalance"] = *addressbalance
 
 		info = append(info, userinfo)
@@ -302,110 +431,242 @@ func RefreshAllAccount(client *ethclient.Client) (*[]map[string]string, bool) {
 	return &info, true
 }
 
-// StartATransaction : start a transaction, returns the hash
-func StartATransaction(client *ethclient.Client, value *big.Int, from, to string, privateKey *ecdsa.PrivateKey) (*string, error) {
+// StartATransaction : start a transaction of type tp, returns the transaction to save
+func StartATransaction(client *ethclient.Client, value *big.Int, from, to, tp string, privateKey *ecdsa.PrivateKey) (*MyTransaction, error) {
 	// generate transaction
-	gasLimit := uint64(80000)
+	unsigned, err := BuildTransaction(client, value, from, to, tp)
+	if err != nil {
+		return nil, err
+	}
 
-	gasPrice, err := client.SuggestGasPrice(context.Background())
+	return SignAndSend(client, unsigned, privateKey)
+}
+
+// SignAndSend : sign a built transaction with privateKey and send it, returns the transaction to save
+func SignAndSend(client *ethclient.Client, unsigned *UnsignedTx, privateKey *ecdsa.PrivateKey) (*MyTransaction, error) {
+	tx, err := unsigned.Transaction()
+	if err != nil {
+		ReleaseNonce(unsigned.From, unsigned.Nonce)
+		return nil, err
+	}
+
+	// sign the transaction
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(tx.ChainId()), privateKey)
 	if err != nil {
+		ReleaseNonce(unsigned.From, unsigned.Nonce)
 		return nil, err
 	}
 
-	delta := new(big.Int)
-	delta, _ = delta.SetString("5000000000", 10)
-	gasPrice = gasPrice.Add(gasPrice, delta)
+	// send transactions, the nonce is handed out again if it never reached the node
+	err = client.SendTransaction(context.Background(), signedTx)
+	if err != nil {
+		ReleaseSentNonce(client, unsigned.From, unsigned.Nonce, err)
+		return nil, err
+	}
 
-	fromAddress := common.HexToAddress(from)
-	toAddress := common.HexToAddress(to)
+	mytx, err := DecomposeTransaction(client, signedTx, unsigned.Type)
+	if err != nil {
+		return nil, err
+	}
+	mytx.GasEstimate = unsigned.GasEstimate
+
+	return mytx, nil
+}
+
+// BuildTransaction : returns an unsigned transaction of type tp with fees, gas limit, chain id
+// and a reserved nonce, the caller releases the nonce if the transaction is never sent
+func BuildTransaction(client *ethclient.Client, value *big.Int, from, to, tp string) (*UnsignedTx, error) {
+	return BuildCall(client, value, from, to, tp, nil)
+}
 
-	nonce, err := client.PendingNonceAt(context.Background(), fromAddress)
+// BuildCall : BuildTransaction with call data, such as a token transfer
+func BuildCall(client *ethclient.Client, value *big.Int, from, to, tp string, data []byte) (*UnsignedTx, error) {
+	fees, err := SuggestFees(client)
 	if err != nil {
 		return nil, err
 	}
 
-	var data []byte
-	tx := types.NewTransaction(nonce, toAddress, value, gasLimit, gasPrice, data)
+	toAddress := common.HexToAddress(to)
 
-	// get chain id
-	chainID, err := client.NetworkID(context.Background())
+	gasLimit, estimate, err := EstimateGasLimit(client, from, toAddress, value, data)
 	if err != nil {
 		return nil, err
 	}
 
-	// sign the transaction
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), privateKey)
+	// get chain id
+	chainID, err := client.ChainID(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	// send transactions
-	err = client.SendTransaction(context.Background(), signedTx)
+	nonce, err := ReserveNonce(client, from)
 	if err != nil {
 		return nil, err
 	}
 
-	hash := signedTx.Hash().Hex()
+	unsigned := UnsignedTx{
+		Type:        tp,
+		ChainID:     chainID.String(),
+		From:        strings.ToLower(from),
+		To:          strings.ToLower(to),
+		Value:       value.String(),
+		Nonce:       nonce,
+		Gas:         gasLimit,
+		GasEstimate: estimate,
+	}
+	if len(data) > 0 {
+		unsigned.Data = hexutil.Encode(data)
+	}
+	if fees.IsDynamic() {
+		unsigned.GasFeeCap = fees.GasFeeCap.String()
+		unsigned.GasTipCap = fees.GasTipCap.String()
+	} else {
+		unsigned.GasPrice = fees.GasPrice.String()
+	}
 
-	return &hash, nil
+	return &unsigned, nil
 }
 
-// SaveATransaction : save a transaction to account info file
-func SaveATransaction(address, hash, tp, amount string) error {
-	// read account info
-	dataptr, err := ReadFileContent(AccountInfoPath + address + ".txt")
+// EstimateGasLimit : returns the gas limit for a transaction and the node's estimate it is derived from,
+// the limit is gaslimitmultiplier percent of the estimate and at most gaslimitcap
+func EstimateGasLimit(client *ethclient.Client, from string, to common.Address, value *big.Int, data []byte) (uint64, uint64, error) {
+	msg := ethereum.CallMsg{From: common.HexToAddress(from), To: &to, Value: value, Data: data}
+
+	estimate, err := client.EstimateGas(context.Background(), msg)
 	if err != nil {
-		return errors.New(("fail to open account info file: " + err.Error()))
+		return 0, 0, errors.New("fail to estimate gas: " + err.Error())
 	}
 
-	data := *dataptr
+	limit := uint64(config.GasLimitCap)
+	if estimate > limit {
+		return 0, 0, errors.New("fail to estimate gas: " + strconv.FormatUint(estimate, 10) + " exceeds the cap")
+	}
 
-	// get balance, addrbalance and transactions
-	var balance, addrbalance, pendingbalance *big.Int
-	if value, ok := data["balance"].(string); ok {
-		balance = new(big.Int)
-		balance, _ = balance.SetString(value, 10)
+	gasLimit := estimate * uint64(config.GasLimitMultiplier) / 100
+	if gasLimit > limit {
+		gasLimit = limit
 	}
-	if value, ok := data["addrbalance"].(string); ok {
-		addrbalance = new(big.Int)
-		addrbalance, _ = addrbalance.SetString(value, 10)
+
+	return gasLimit, estimate, nil
+}
+
+// SaveATransaction : save a new pending transaction to account ledger
+func SaveATransaction(address string, transaction *MyTransaction) error {
+	return store.Update(func(tx StorageTx) error {
+		// read ledger
+		info, err := GetAccountInfo(tx, address)
+		if err != nil {
+			return errors.New("fail to open account info: " + err.Error())
+		}
+
+		transaction.Status = "0"
+		if transaction.Created == 0 {
+			transaction.Created = time.Now().Unix()
+		}
+		info.Transactions = append(info.Transactions, *transaction)
+
+		// save new ledger
+		err = PutAccountInfo(tx, address, info)
+		if err != nil {
+			return errors.New("fail to write account info: " + err.Error())
+		}
+
+		return nil
+	})
+}
+
+// WithdrawFunds : send value from the hot wallet to to on behalf of address and save it to the ledger,
+// the balance must cover value, and the fee if the user pays it
+func WithdrawFunds(client *ethclient.Client, address, to string, value *big.Int) (*MyTransaction, error) {
+	// one withdrawal at a time per user, so two cannot both pass the balance check
+	unlock := LockWithdrawal(address)
+	defer unlock()
+
+	return sendWithdrawal(client, address, to, value, 0)
+}
+
+// sendWithdrawal : WithdrawFunds for a caller holding LockWithdrawal, request is the approved withdraw request
+// of a withdrawal above ApprovalThreshold
+func sendWithdrawal(client *ethclient.Client, address, to string, value *big.Int, request uint64) (*MyTransaction, error) {
+	_, err := CheckWithdrawal(client, address, to, value, request)
+	if err != nil {
+		return nil, err
 	}
-	if value, ok := data["pendingbalance"].(string); ok {
-		pendingbalance = new(big.Int)
-		pendingbalance, _ = pendingbalance.SetString(value, 10)
+
+	// get privateKey
+	privateKey, err := LoadPrivateKey(config.MainAddress)
+	if err != nil {
+		return nil, errors.New("fail to get privateKey: " + err.Error())
 	}
-	var transactions []interface{}
-	if value, ok := data["transactions"].([]interface{}); ok {
-		transactions = value
+
+	// send transaction
+	tx, err := StartATransaction(client, value, config.MainAddress, to, "1", privateKey)
+	if err != nil {
+		return nil, errors.New("fail to withdraw: " + err.Error())
 	}
 
-	transaction := MyTransaction{Hash: hash, Type: tp, Status: "0", Amount: amount}
-	transactions = append(transactions, TransactionToMap(&transaction))
+	// save transaction
+	err = SaveATransaction(address, tx)
+	if err != nil {
+		return nil, errors.New("fail to save transaction: " + err.Error())
+	}
 
-	// generate new info
-	newinfo := make(map[string]interface{})
-	newinfo["balance"] = balance.String()
-	newinfo["addrbalance"] = addrbalance.String()
-	newinfo["pendingbalance"] = pendingbalance.String()
-	newinfo["transactions"] = transactions
+	return tx, nil
+}
 
-	newinfodata, err := json.MarshalIndent(newinfo, "", "")
+// CheckWithdrawal : returns an error unless address may withdraw value to to, otherwise the amount
+// the withdrawal needs, the caller holds LockWithdrawal until the withdrawal is saved,
+// a withdrawal above ApprovalThreshold must be the approved withdraw request
+func CheckWithdrawal(client *ethclient.Client, address, to string, value *big.Int, request uint64) (*big.Int, error) {
+	held, err := checkApproval(address, to, value, request)
 	if err != nil {
-		return errors.New(("fail to write user file: " + err.Error()))
+		return nil, err
 	}
 
-	// save new data
-	file, err := os.Create(AccountInfoPath + address + ".txt")
+	return checkFunds(client, address, to, value, held)
+}
+
+// checkFunds : CheckWithdrawal but the approval, for a withdrawal that is only about to be requested,
+// held is what the ledger already reserves for this very withdrawal and counts as available
+func checkFunds(client *ethclient.Client, address, to string, value, held *big.Int) (*big.Int, error) {
+	err := CheckWhitelisted(address, to)
+	if err != nil {
+		return nil, err
+	}
+	if value.Sign() <= 0 {
+		return nil, errors.New("invalid value " + value.String())
+	}
+	err = CheckLimits(address, value)
 	if err != nil {
-		return errors.New(("fail to write user file: " + err.Error()))
+		return nil, err
 	}
 
-	defer file.Close()
+	// get balance
+	_, balancestr, err := RefreshAccountInfo(client, address)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = file.WriteString(string(newinfodata))
+	balance, err := ParseAmount(*balancestr)
 	if err != nil {
-		return errors.New(("fail to write user file: " + err.Error()))
+		return nil, errors.New("fail to get balance: " + err.Error())
 	}
+	balance.Add(balance, held)
 
-	return nil
+	// the user needs to cover the fee as well if they pay it
+	required := new(big.Int).Set(value)
+	if WithdrawFeePolicy == "user" {
+		maxfee, err := EstimateMaxFee(client, config.MainAddress, to, value)
+		if err != nil {
+			return nil, errors.New("fail to estimate fee: " + err.Error())
+		}
+		required.Add(required, maxfee)
+	}
+
+	// compare balance to value
+	if balance.Cmp(required) == -1 {
+		return nil, errors.New("balance is not enough")
+	}
+
+	return required, nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// the ERC-20 function selectors
+var (
+	balanceOfSelector = crypto.Keccak256([]byte("balanceOf(address)"))[:4]
+	transferSelector  = crypto.Keccak256([]byte("transfer(address,uint256)"))[:4]
+)
+
+// TokenBalance : returns the ERC-20 balance of address in token at block, the latest if block is nil
+func TokenBalance(client *ethclient.Client, token, address string, block *big.Int) (*big.Int, error) {
+	contract := common.HexToAddress(token)
+	data := append(append([]byte{}, balanceOfSelector...), common.LeftPadBytes(common.HexToAddress(address).Bytes(), 32)...)
+
+	result, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &contract, Data: data}, block)
+	if err != nil {
+		return nil, errors.New("fail to get token balance: " + err.Error())
+	}
+	if len(result) != 32 {
+		return nil, errors.New("fail to get token balance: " + token + " is not an ERC-20 token")
+	}
+
+	return new(big.Int).SetBytes(result), nil
+}
+
+// TransferData : returns the call data of an ERC-20 transfer of amount to to
+func TransferData(to string, amount *big.Int) []byte {
+	data := append([]byte{}, transferSelector...)
+	data = append(data, common.LeftPadBytes(common.HexToAddress(to).Bytes(), 32)...)
+	return append(data, common.LeftPadBytes(amount.Bytes(), 32)...)
+}
+
+// ParseTransferData : returns the recipient and the amount of the call data of an ERC-20 transfer
+func ParseTransferData(data []byte) (string, *big.Int, error) {
+	if len(data) != 4+32+32 || !bytes.Equal(data[:4], transferSelector) {
+		return "", nil, errors.New("not an ERC-20 transfer")
+	}
+
+	return common.BytesToAddress(data[4:36]).Hex(), new(big.Int).SetBytes(data[36:]), nil
+}
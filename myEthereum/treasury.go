@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// RefillRequest : a transfer from the cold wallet to the hot wallet exported for offline signing,
+// at most one is outstanding until it is imported or discarded
+type RefillRequest struct {
+	File    string `json:"file"`
+	Created int64  `json:"created"`
+	Nonce   uint64 `json:"nonce"`
+	Value   string `json:"value"`
+}
+
+// Rebalance : what a rebalance of the hot wallet did, at most one of Sweep and Refill is set
+type Rebalance struct {
+	Balance string         `json:"balance"`
+	Sweep   *MyTransaction `json:"sweep,omitempty"`
+	Refill  *RefillRequest `json:"refill,omitempty"`
+	Note    string         `json:"note,omitempty"`
+}
+
+// rebalancelock keeps the background watcher, centralize and manual rebalances from moving funds twice
+var rebalancelock sync.Mutex
+
+// RebalanceHotWallet : keep the hot wallet between the watermarks, sending what is above the
+// high mark to the cold wallet, or exporting a refill from the cold wallet when it is below the low mark,
+// both bring it back to halfway between the marks
+// the transfers are recorded in the ledger of the cold wallet, and nothing moves while one is pending
+func RebalanceHotWallet(client *ethclient.Client) (*Rebalance, error) {
+	if config.ColdAddress == "" {
+		return nil, errors.New("no cold wallet is configured")
+	}
+
+	rebalancelock.Lock()
+	defer rebalancelock.Unlock()
+
+	low, high, err := config.Watermarks()
+	if err != nil {
+		return nil, err
+	}
+	target := new(big.Int).Add(low, high)
+	target.Div(target, big.NewInt(2))
+
+	// settle earlier transfers first
+	_, _, err = RefreshAccountInfo(client, config.ColdAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := client.PendingBalanceAt(context.Background(), common.HexToAddress(config.MainAddress))
+	if err != nil {
+		return nil, errors.New("fail to get balance: " + err.Error())
+	}
+	rebalance := Rebalance{Balance: balance.String()}
+
+	pending := false
+	var refill *RefillRequest
+	err = store.View(func(tx StorageTx) error {
+		info, err := GetAccountInfo(tx, config.ColdAddress)
+		if err != nil {
+			return err
+		}
+		for _, t := range info.Transactions {
+			if t.Status == "0" {
+				pending = true
+			}
+		}
+
+		var request RefillRequest
+		found, err := tx.Get(BucketMeta, MetaRefillRequest, &request)
+		if found {
+			refill = &request
+		}
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("fail to open cold wallet ledger: " + err.Error())
+	}
+
+	switch {
+	case pending:
+		rebalance.Note = "a transfer between the hot and the cold wallet is pending"
+	case refill != nil:
+		rebalance.Note = "refill request " + refill.File + " is waiting to be signed and imported"
+	case balance.Cmp(high) > 0:
+		rebalance.Sweep, err = sweepToCold(client, new(big.Int).Sub(balance, target))
+	case balance.Cmp(low) < 0:
+		rebalance.Refill, err = exportRefill(client, new(big.Int).Sub(target, balance))
+	default:
+		rebalance.Note = "the hot wallet is between the watermarks"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &rebalance, nil
+}
+
+// sweepToCold : send value from the hot wallet to the cold wallet
+func sweepToCold(client *ethclient.Client, value *big.Int) (*MyTransaction, error) {
+	privateKey, err := LoadPrivateKey(config.MainAddress)
+	if err != nil {
+		return nil, errors.New("fail to get privateKey: " + err.Error())
+	}
+
+	tx, err := StartATransaction(client, value, config.MainAddress, config.ColdAddress, "3", privateKey)
+	if err != nil {
+		return nil, errors.New("fail to sweep to the cold wallet: " + err.Error())
+	}
+
+	err = SaveATransaction(config.ColdAddress, tx)
+	if err != nil {
+		return nil, errors.New("fail to save transaction: " + err.Error())
+	}
+
+	return tx, nil
+}
+
+// exportRefill : write an unsigned transfer of value from the cold wallet to the hot wallet
+// to the data directory, for signing on the machine holding the cold key
+func exportRefill(client *ethclient.Client, value *big.Int) (*RefillRequest, error) {
+	cold, err := client.BalanceAt(context.Background(), common.HexToAddress(config.ColdAddress), nil)
+	if err != nil {
+		return nil, errors.New("fail to get balance: " + err.Error())
+	}
+	if cold.Cmp(value) < 0 {
+		return nil, errors.New("the hot wallet needs " + value.String() + " but the cold wallet holds " + cold.String())
+	}
+
+	unsigned, err := BuildTransaction(client, value, config.ColdAddress, config.MainAddress, "4")
+	if err != nil {
+		return nil, errors.New("fail to build refill: " + err.Error())
+	}
+	unsigned.Ledger = config.ColdAddress
+
+	batch := OfflineBatch{Created: time.Now().Unix(), Transactions: []UnsignedTx{*unsigned}}
+	request := RefillRequest{
+		File:    config.DataPath(fmt.Sprintf("refill-%d.json", batch.Created)),
+		Created: batch.Created,
+		Nonce:   unsigned.Nonce,
+		Value:   value.String(),
+	}
+
+	err = ExportBatch(&batch, request.File)
+	if err == nil {
+		err = store.Update(func(tx StorageTx) error {
+			return tx.Put(BucketMeta, MetaRefillRequest, &request)
+		})
+	}
+	if err != nil {
+		ReleaseBatch(&batch)
+		return nil, errors.New("fail to export refill: " + err.Error())
+	}
+
+	return &request, nil
+}
+
+// GetRefillRequest : returns the outstanding refill request, nil if there is none
+func GetRefillRequest() (*RefillRequest, error) {
+	var request RefillRequest
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketMeta, MetaRefillRequest, &request)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// DiscardRefillRequest : give up the outstanding refill request, its file must not be imported afterwards
+func DiscardRefillRequest() error {
+	request, err := GetRefillRequest()
+	if err != nil {
+		return err
+	}
+	if request == nil {
+		return errors.New("there is no refill request")
+	}
+
+	err = ClearRefillRequest(request.Nonce)
+	if err != nil {
+		return err
+	}
+
+	return releaseExported(config.ColdAddress, request.Nonce)
+}
+
+// ClearRefillRequest : forget the outstanding refill request if it has nonce, once it is imported or discarded
+func ClearRefillRequest(nonce uint64) error {
+	return store.Update(func(tx StorageTx) error {
+		var request RefillRequest
+		found, err := tx.Get(BucketMeta, MetaRefillRequest, &request)
+		if err != nil || !found || request.Nonce != nonce {
+			return err
+		}
+
+		return tx.Delete(BucketMeta, MetaRefillRequest)
+	})
+}
+
+// WatchHotWallet : rebalance the hot wallet periodically, never returns,
+// the hot wallet is left alone while its key is not in the keystore
+func WatchHotWallet(client *ethclient.Client) {
+	logged := false
+	for {
+		if !HasKey(config.MainAddress) {
+			if !logged {
+				fmt.Println("rebalance skipped: no key for the hot wallet " + config.MainAddress + " in the keystore")
+				logged = true
+			}
+		} else if _, err := RebalanceHotWallet(client); err != nil {
+			fmt.Println("rebalance failed: ", err)
+		}
+
+		time.Sleep(RebalanceInterval)
+	}
+}
@@ -2,59 +2,114 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/ecdsa"
 	"fmt"
 	"math/big"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
-// Login : user log in
-func Login() bool {
-	fmt.Println("please input your mnemonic:")
-	reader := bufio.NewReader(os.Stdin)
-	mnemonic, _, _ := reader.ReadLine()
-
-	if LoginAnAccount(string(mnemonic)) {
-		fmt.Println("welcome, " + curuser)
-		return true
+// Login : user log in by name and password, or by mnemonic for legacy accounts, returns nil if it fails
+func Login() *Session {
+	var name, password string
+	fmt.Println("please input your name (if skipped, log in with the mnemonic of a legacy account):")
+	fmt.Scanln(&name)
+
+	var session *Session
+	var err error
+	if name != "" {
+		fmt.Println("please input your password:")
+		fmt.Scanln(&password)
+
+		session, err = LoginUser(name, password)
+	} else {
+		fmt.Println("please input your mnemonic:")
+		reader := bufio.NewReader(os.Stdin)
+		mnemonic, _, _ := reader.ReadLine()
+
+		session, err = LoginAnAccount(string(mnemonic))
+	}
+	if err != nil {
+		fmt.Println("failed to log in: ", err)
+		return nil
 	}
 
-	fmt.Println("failed to log in: wrong mnemonic")
-	return false
+	fmt.Println("welcome, " + session.Address)
+	return session
 }
 
-// LoginAsAdmin : log in as an admin
-func LoginAsAdmin() bool {
-	var password string
+// LoginAsAdmin : log in as an admin, returns nil if it fails
+// the first admin login creates the superadmin
+func LoginAsAdmin() *Session {
+	exists, err := HasAdmins()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	if !exists {
+		fmt.Println("there is no admin yet, create the superadmin with -createadmin")
+		return nil
+	}
+
+	var name, password string
+	fmt.Println("please input admin name:")
+	fmt.Scanln(&name)
 	fmt.Println("please input admin password:")
 	fmt.Scanln(&password)
 
-	if password != "admin" {
-		fmt.Println("wrong password")
-		return false
+	session, err := LoginAdmin(name, password)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	fmt.Println("welcome, " + session.Name + " (" + session.Role + ")")
+	return session
+}
+
+// Logout : end a session
+func Logout(session *Session) {
+	err := EndSession(session.Token)
+	if err != nil {
+		fmt.Println("failed to log out: ", err)
+		return
 	}
 
-	return true
+	fmt.Println("logged out")
 }
 
 // Register : user registers
 func Register() {
-	_, mnemonic, err := RegisterAnAccount()
+	var name, password string
+	fmt.Println("please input your name:")
+	fmt.Scanln(&name)
+	fmt.Println("please input your password (at least 8 characters):")
+	fmt.Scanln(&password)
+
+	address, err := RegisterAnAccount(name, password)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	fmt.Printf("succeeded to register, your mnemonic is:\n%s\n", *mnemonic)
+	fmt.Printf("succeeded to register, your deposit address is:\n%s\n", *address)
 }
 
-// CheckBalance : check the balance in current account
-func CheckBalance(client *ethclient.Client) {
-	_, balance, err := RefreshAccountInfo(client, curuser)
+// CheckBalance : check the balance of the session's account
+func CheckBalance(client *ethclient.Client, session *Session) {
+	if err := session.Valid("user"); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	_, balance, err := RefreshAccountInfo(client, session.Address)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -63,8 +118,13 @@ func CheckBalance(client *ethclient.Client) {
 	fmt.Printf("your balance is:\n%s\n", *balance)
 }
 
-// Recharge : recharge
-func Recharge(client *ethclient.Client) {
+// Recharge : recharge the session's account
+func Recharge(client *ethclient.Client, session *Session) {
+	if err := session.Valid("user"); err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	// get privateKey
 	var privateKeyFile, password string
 	fmt.Println("please input your key file path:")
@@ -107,42 +167,32 @@ func Recharge(client *ethclient.Client) {
 	}
 
 	// send transaction
-	hash, err := StartATransaction(client, value, ethaddress, curuser, privateKey)
+	tx, err := StartATransaction(client, value, ethaddress, session.Address, "0", privateKey)
 	if err != nil {
 		fmt.Println("fail to recharge: ", err)
 		return
 	}
 
 	// save transaction
-	err = SaveATransaction(curuser, *hash, "0", valuestr)
+	err = SaveATransaction(session.Address, tx)
 	if err != nil {
 		fmt.Println("fail to save transaction: ", err)
 		return
 	}
 
-	fmt.Printf("transaction submitted:%v\n", *hash)
+	fmt.Printf("transaction submitted:%v\n", tx.Hash)
 }
 
-// Withdraw : Withdraw
-func Withdraw(client *ethclient.Client) {
-	// get privateKey
-	mk := keystoremap[strings.ToLower(MainAddress)]
-	mp := "admin"
-	keyValue, err := GetPrivateKey(&mk, &mp)
-	if err != nil {
-		fmt.Println("failed to get privateKey: ", err)
-		return
-	}
-
-	privateKey, err := crypto.HexToECDSA(*keyValue)
-	if err != nil {
-		fmt.Println("failed to get privateKey: ", err)
+// Withdraw : withdraw from the session's account
+func Withdraw(client *ethclient.Client, session *Session) {
+	if err := session.Valid("user"); err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	// get address
+	// get address, only whitelisted addresses past their cool-down are accepted
 	var ethaddress string
-	fmt.Println("please input your ethereum address:")
+	fmt.Println("please input the whitelisted address to withdraw to:")
 	fmt.Scanln(&ethaddress)
 
 	// get value
@@ -157,99 +207,596 @@ func Withdraw(client *ethclient.Client) {
 		return
 	}
 
-	// get balance
-	_, balancestr, err := RefreshAccountInfo(client, curuser)
+	tx, request, err := RequestWithdrawal(client, session.Address, ethaddress, value)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	balance := new(big.Int)
-	balance, ok = balance.SetString(*balancestr, 10)
-	if !ok {
-		fmt.Println("invalid input")
+	if request != nil {
+		fmt.Printf("withdraw request #%d is waiting for approval\n", request.ID)
 		return
 	}
+	fmt.Printf("transaction submitted: %v\n", tx.Hash)
+}
 
-	// compare balance to value
-	if balance.Cmp(value) == -1 {
-		fmt.Println("balance is not enough")
+// WithdrawalAddresses : list, add or remove the user's whitelisted withdrawal addresses
+func WithdrawalAddresses(session *Session) {
+	if err := session.Valid("user"); err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	// send transaction
-	hash, err := StartATransaction(client, value, MainAddress, ethaddress, privateKey)
+	whitelist, err := GetWhitelist(session.Address)
 	if err != nil {
-		fmt.Println("fail to recharge: ", err)
+		fmt.Println(err)
 		return
 	}
 
-	// save transaction
-	err = SaveATransaction(curuser, *hash, "1", valuestr)
-	if err != nil {
-		fmt.Println("fail to save transaction: ", err)
-		return
+	for _, entry := range whitelist {
+		usable := time.Unix(entry.Usable, 0)
+		state := "usable"
+		if time.Now().Before(usable) {
+			state = "usable from " + usable.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%s\t%s\t%s\n", entry.Address, entry.Label, state)
 	}
 
-	fmt.Printf("transaction submitted: %v\n", *hash)
+	var option int
+	fmt.Println("0: add address\t1: remove address\t2: back")
+	fmt.Scanln(&option)
+
+	var address, label string
+	switch option {
+	case 0:
+		fmt.Println("please input the address, with its EIP-55 checksum as your wallet shows it:")
+		fmt.Scanln(&address)
+		fmt.Println("please input a label (optional):")
+		fmt.Scanln(&label)
+
+		entry, err := AddWhitelistAddress(session.Address, address, label)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%s added, usable from %s\n", entry.Address, time.Unix(entry.Usable, 0).Format("2006-01-02 15:04:05"))
+	case 1:
+		fmt.Println("please input the address:")
+		fmt.Scanln(&address)
+
+		err = RemoveWhitelistAddress(session.Address, address)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("done")
+	}
 }
 
 // Centralize : centralize all the balance in user accounts
-func Centralize(client *ethclient.Client) {
-	// refresh all accounts
-	info, ok := RefreshAllAccount(client)
-	if !ok {
-		fmt.Println("failed to refresh balance")
+func Centralize(client *ethclient.Client, session *Session) {
+	if !authorize(session, "centralize", "") {
 		return
 	}
 
-	fmt.Println("refresh accounts done")
+	jobs, err := GetCentralizeJobs(5)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, job := range jobs {
+		fmt.Println(FormatJobSummary(job))
+	}
 
-	// send transactions
-	for _, userinfo := range *info {
-		// if address balance is 0, then continue
-		if userinfo["addressbalance"] == "0" {
-			continue
+	var option int
+	fmt.Println("0: new run\t1: resume a job\t2: back")
+	fmt.Scanln(&option)
+
+	var job *CentralizeJob
+	switch option {
+	case 0:
+		job, err = StartCentralize(client, session)
+	case 1:
+		var id uint64
+		fmt.Println("please input the job id:")
+		_, err = fmt.Scanln(&id)
+		if err != nil {
+			fmt.Println("invalid input")
+			return
 		}
+		job, err = ResumeCentralize(client, id)
+	default:
+		return
+	}
+
+	// report the addresses handled before a failure too
+	detail := "centralize"
+	if job != nil {
+		for _, item := range job.Items {
+			fmt.Println(FormatSweepItem(item))
+		}
+		detail = FormatJobSummary(*job)
+		fmt.Println(detail)
+	}
+	audit(session, "centralize", detail, err)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println("centralize done")
+
+	// move the excess of the hot wallet on to the cold wallet
+	if config.ColdAddress != "" {
+		rebalance(client, session)
+	}
+}
+
+// RebalanceWallets : keep the hot wallet between its watermarks, or discard the outstanding refill request
+func RebalanceWallets(client *ethclient.Client, session *Session) {
+	if !authorize(session, "rebalance", "") {
+		return
+	}
+	if config.ColdAddress == "" {
+		fmt.Println("no cold wallet is configured")
+		return
+	}
+
+	refill, err := GetRefillRequest()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if refill != nil {
+		fmt.Printf("refill of %s waiting in %s since %s\n", refill.Value, refill.File,
+			time.Unix(refill.Created, 0).Format("2006-01-02 15:04:05"))
+	}
 
-		// get privateKey
-		mk := keystoremap[strings.ToLower(userinfo["address"])]
-		mp := "admin"
+	var option int
+	fmt.Println("0: rebalance now\t1: discard refill request\t2: back")
+	fmt.Scanln(&option)
 
-		keyValue, err := GetPrivateKey(&mk, &mp)
+	switch option {
+	case 0:
+		rebalance(client, session)
+	case 1:
+		err = DiscardRefillRequest()
+		audit(session, "rebalance", "discard refill request", err)
 		if err != nil {
-			fmt.Println("failed to get privateKey: ", err)
+			fmt.Println("failed to discard refill request: ", err)
 			return
 		}
+		fmt.Println("done, do not import the discarded file")
+	}
+}
+
+// rebalance : rebalance the hot wallet and print what was done
+func rebalance(client *ethclient.Client, session *Session) {
+	result, err := RebalanceHotWallet(client)
+	if err != nil {
+		audit(session, "rebalance", "rebalance", err)
+		fmt.Println("failed to rebalance: ", err)
+		return
+	}
 
-		privateKey, err := crypto.HexToECDSA(*keyValue)
+	switch {
+	case result.Sweep != nil:
+		audit(session, "rebalance", "sweep "+result.Sweep.Amount+" to the cold wallet", nil)
+		fmt.Printf("hot wallet holds %s, swept %s to the cold wallet: %s\n", result.Balance, result.Sweep.Amount, result.Sweep.Hash)
+	case result.Refill != nil:
+		audit(session, "rebalance", "export refill of "+result.Refill.Value+" to "+result.Refill.File, nil)
+		fmt.Printf("hot wallet holds %s, refill of %s written to %s, sign it with -sign on the offline machine and import it\n",
+			result.Balance, result.Refill.Value, result.Refill.File)
+	default:
+		fmt.Printf("hot wallet holds %s, %s\n", result.Balance, result.Note)
+	}
+}
+
+// ScanAllDeposits : credit deposits in all the blocks up to the confirmed head
+func ScanAllDeposits(client *ethclient.Client, session *Session) {
+	if !authorize(session, "scan", "") {
+		return
+	}
+
+	credited, err := ScanDeposits(client)
+	audit(session, "scan", fmt.Sprintf("%d deposits credited", credited), err)
+	if err != nil {
+		fmt.Println("failed to scan deposits: ", err)
+		return
+	}
+
+	fmt.Printf("scan done, %d deposits credited\n", credited)
+}
+
+// SpeedUpOrCancel : replace a stuck withdrawal of a user
+func SpeedUpOrCancel(client *ethclient.Client, session *Session, cancel bool) {
+	var address, hash string
+	fmt.Println("please input the user address:")
+	fmt.Scanln(&address)
+	fmt.Println("please input the transaction hash:")
+	fmt.Scanln(&hash)
+
+	detail := "speed up " + hash + " of " + address
+	if cancel {
+		detail = "cancel " + hash + " of " + address
+	}
+	if !authorize(session, "replace", detail) {
+		return
+	}
+
+	newhash, err := ReplaceTransaction(client, address, hash, cancel)
+	if err == nil {
+		detail += " by " + *newhash
+	}
+	audit(session, "replace", detail, err)
+	if err != nil {
+		fmt.Println("failed to replace transaction: ", err)
+		return
+	}
+
+	fmt.Printf("replacement submitted: %v\n", *newhash)
+}
+
+// ReconcileAccounts : compare the ledger with the chain and report discrepancies
+func ReconcileAccounts(client *ethclient.Client, session *Session) {
+	if !authorize(session, "report", "") {
+		return
+	}
+
+	var blockstr string
+	fmt.Println("please input the block number (if skipped, the latest block will be used):")
+	fmt.Scanln(&blockstr)
+
+	var block uint64
+	if blockstr == "" {
+		head, err := client.BlockNumber(context.Background())
 		if err != nil {
-			fmt.Println("failed to get privateKey: ", err)
+			fmt.Println("failed to get block number: ", err)
 			return
 		}
+		block = head
+	} else {
+		var err error
+		block, err = strconv.ParseUint(blockstr, 10, 64)
+		if err != nil {
+			fmt.Println("invalid input")
+			return
+		}
+	}
+
+	report, err := Reconcile(client, block)
+	audit(session, "report", "block "+strconv.FormatUint(block, 10), err)
+	if err != nil {
+		fmt.Println("failed to reconcile: ", err)
+		return
+	}
+
+	fmt.Printf("block %d: liabilities %s, assets %s\n", report.Block, report.Liabilities, report.Assets)
+	if !report.Covered {
+		fmt.Println("warning: user balances are not covered by the hot wallet and user addresses")
+	}
+
+	if len(report.Discrepancies) == 0 {
+		fmt.Println("no discrepancies")
+		return
+	}
+
+	for _, d := range report.Discrepancies {
+		fmt.Printf("[%s] ledger %s, chain %s, delta %s: %s\n", d.Address, d.Ledger, d.Chain, d.Delta, d.Cause)
+	}
+
+	// writing adjustments is not for auditors
+	if session.Allow("reconcile") != nil {
+		return
+	}
+
+	var answer string
+	fmt.Println("write the adjustment journal for review? (y/n)")
+	fmt.Scanln(&answer)
+	if answer != "y" {
+		return
+	}
+
+	path, err := SaveAdjustments(report)
+	audit(session, "reconcile", "write adjustment journal "+path, err)
+	if err != nil {
+		fmt.Println("failed to write adjustment journal: ", err)
+		return
+	}
+
+	fmt.Println("adjustment journal written to " + path)
+}
 
-		// get value
-		value := new(big.Int)
-		value, ok := value.SetString(userinfo["addressbalance"], 10)
+// ExportOffline : build unsigned withdrawal or centralize transactions and write them to a batch file
+func ExportOffline(client *ethclient.Client, session *Session) {
+	if !authorize(session, "offline", "") {
+		return
+	}
+
+	var option int
+	fmt.Println("0: withdrawal\t1: centralize\t2: back")
+	fmt.Scanln(&option)
+
+	batch := OfflineBatch{Created: time.Now().Unix()}
+	var detail string
+	var err error
+	switch option {
+	case 0:
+		var address, ethaddress, valuestr, requeststr string
+		fmt.Println("please input the user address:")
+		fmt.Scanln(&address)
+		fmt.Println("please input the ethereum address to withdraw to:")
+		fmt.Scanln(&ethaddress)
+		fmt.Println("please input the value:")
+		fmt.Scanln(&valuestr)
+		fmt.Println("please input the approved withdraw request id (if skipped, the value must be within the approval threshold):")
+		fmt.Scanln(&requeststr)
+
+		value, ok := new(big.Int).SetString(valuestr, 10)
 		if !ok {
 			fmt.Println("invalid input")
 			return
 		}
+		var request uint64
+		if requeststr != "" {
+			request, err = strconv.ParseUint(requeststr, 10, 64)
+			if err != nil {
+				fmt.Println("invalid input")
+				return
+			}
+		}
 
-		// send transaction
-		hash, err := StartATransaction(client, value, userinfo["address"], MainAddress, privateKey)
-		if err != nil {
-			fmt.Println("failed to centalize: ", err)
-			return
+		detail = "export withdrawal of " + valuestr + " from " + address + " to " + ethaddress
+		var unsigned *UnsignedTx
+		unsigned, err = ExportWithdrawal(client, address, ethaddress, value, request)
+		if err == nil {
+			batch.Transactions = []UnsignedTx{*unsigned}
 		}
+	case 1:
+		detail = "export centralize"
+		batch.Transactions, err = ExportCentralize(client)
+	default:
+		return
+	}
 
-		// save transaction
-		err = SaveATransaction(userinfo["address"], *hash, "2", userinfo["pendingbalance"])
+	path := config.DataPath(fmt.Sprintf("unsigned-%d.json", batch.Created))
+	if err == nil {
+		err = ExportBatch(&batch, path)
 		if err != nil {
-			fmt.Println("fail to save transaction: ", err)
-			return
+			ReleaseBatch(&batch)
 		}
+	}
+	audit(session, "offline", detail+" to "+path, err)
+	if err != nil {
+		fmt.Println("failed to export: ", err)
+		return
+	}
+
+	fmt.Printf("%d transactions written to %s, sign them with -sign on the offline machine\n", len(batch.Transactions), path)
+}
+
+// ImportOffline : broadcast a batch signed offline
+func ImportOffline(client *ethclient.Client, session *Session) {
+	if !authorize(session, "offline", "") {
+		return
+	}
+
+	var path string
+	fmt.Println("please input the signed batch file:")
+	fmt.Scanln(&path)
+
+	batch, err := ReadBatch(path)
+	if err != nil {
+		fmt.Println("failed to read batch: ", err)
+		return
+	}
+
+	sent, err := ImportBatch(client, batch)
+	audit(session, "offline", fmt.Sprintf("import %s, %d of %d sent", path, sent, len(batch.Transactions)), err)
+	for _, unsigned := range batch.Transactions {
+		fmt.Printf("[%s] %s\n", unsigned.Ledger, unsigned.Hash)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Printf("%d of %d transactions sent\n", sent, len(batch.Transactions))
+}
+
+// ReviewWithdrawRequests : list the pending withdraw requests, then approve or reject one
+func ReviewWithdrawRequests(client *ethclient.Client, session *Session) {
+	if !authorize(session, "approve", "") {
+		return
+	}
+
+	requests, err := GetWithdrawRequests("", true)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(requests) == 0 {
+		fmt.Println("no pending withdraw requests")
+		return
+	}
 
-		fmt.Printf("[%s] transaction submitted: %v\n", userinfo["address"], *hash)
+	for _, request := range requests {
+		fmt.Println(FormatWithdrawRequest(request))
+	}
+
+	var option int
+	fmt.Println("0: approve\t1: reject\t2: back")
+	fmt.Scanln(&option)
+	if option != 0 && option != 1 {
+		return
+	}
+
+	var id uint64
+	fmt.Println("please input the request id:")
+	_, err = fmt.Scanln(&id)
+	if err != nil {
+		fmt.Println("invalid input")
+		return
+	}
+
+	var request *WithdrawRequest
+	if option == 0 {
+		request, err = ApproveRequest(client, session, id)
+		audit(session, "approve", fmt.Sprintf("approve withdraw request #%d", id), err)
+	} else {
+		fmt.Println("please input the reason:")
+		reader := bufio.NewReader(os.Stdin)
+		reason, _, _ := reader.ReadLine()
+
+		request, err = RejectRequest(session, id, strings.TrimSpace(string(reason)))
+		audit(session, "approve", fmt.Sprintf("reject withdraw request #%d: %s", id, reason), err)
+	}
+	if err != nil {
+		fmt.Println("failed to review withdraw request: ", err)
+		return
+	}
+
+	fmt.Println(FormatWithdrawRequest(*request))
+}
+
+// ManageOverrides : list, grant or revoke waivers of a user's withdrawal limits
+func ManageOverrides(session *Session) {
+	if !authorize(session, "override", "") {
+		return
+	}
+
+	overrides, err := GetOverrides()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, override := range overrides {
+		fmt.Println(FormatOverride(override))
+	}
+
+	var option int
+	fmt.Println("0: grant override\t1: revoke override\t2: back")
+	fmt.Scanln(&option)
+
+	var address string
+	switch option {
+	case 0:
+		var hours int
+		fmt.Println("please input the user address:")
+		fmt.Scanln(&address)
+		fmt.Println("please input how many hours the override lasts:")
+		fmt.Scanln(&hours)
+		fmt.Println("please input the reason:")
+		reader := bufio.NewReader(os.Stdin)
+		reason, _, _ := reader.ReadLine()
+
+		_, err = GrantOverride(session, address, time.Duration(hours)*time.Hour, strings.TrimSpace(string(reason)))
+		audit(session, "override", fmt.Sprintf("waive the limits of %s for %d hours: %s", address, hours, reason), err)
+	case 1:
+		fmt.Println("please input the user address:")
+		fmt.Scanln(&address)
+
+		err = RevokeOverride(address)
+		audit(session, "override", "revoke the override of "+address, err)
+	default:
+		return
+	}
+
+	if err != nil {
+		fmt.Println("failed to manage overrides: ", err)
+		return
+	}
+
+	fmt.Println("done")
+}
+
+// ManageAdmins : add or remove admin accounts
+func ManageAdmins(session *Session) {
+	if !authorize(session, "manage", "") {
+		return
+	}
+
+	admins, err := GetAdmins()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, admin := range admins {
+		fmt.Printf("%s\t%s\n", admin.Name, admin.Role)
+	}
+
+	var option int
+	fmt.Println("0: add admin\t1: remove admin\t2: back")
+	fmt.Scanln(&option)
+
+	var name, password, role string
+	switch option {
+	case 0:
+		fmt.Println("please input the name:")
+		fmt.Scanln(&name)
+		fmt.Println("please input the password (at least 8 characters):")
+		fmt.Scanln(&password)
+		fmt.Println("please input the role (operator, auditor or superadmin):")
+		fmt.Scanln(&role)
+
+		err = CreateAdmin(name, password, role)
+		audit(session, "manage", "add "+name+" as "+role, err)
+	case 1:
+		fmt.Println("please input the name:")
+		fmt.Scanln(&name)
+
+		err = RemoveAdmin(name)
+		audit(session, "manage", "remove "+name, err)
+	default:
+		return
+	}
+
+	if err != nil {
+		fmt.Println("failed to manage admins: ", err)
+		return
+	}
+
+	fmt.Println("done")
+}
+
+// ViewAuditLog : print the latest entries of the audit log
+func ViewAuditLog(session *Session) {
+	if !authorize(session, "audit", "") {
+		return
+	}
+
+	entries, err := GetAuditLog(50)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, entry := range entries {
+		fmt.Println(FormatAuditEntry(entry))
+	}
+}
+
+// authorize : returns true if the session may run action, a refusal is audited
+func authorize(session *Session, action, detail string) bool {
+	err := session.Allow(action)
+	if err == nil {
+		return true
+	}
+
+	// a session that is gone has no actor to record
+	if session != nil && strings.HasPrefix(err.Error(), "permission denied") {
+		audit(session, action, detail, err)
+	}
+
+	fmt.Println(err)
+	return false
+}
+
+// audit : record an admin action, a failure to record it is only printed
+func audit(session *Session, action, detail string, result error) {
+	err := Audit(session, action, detail, result)
+	if err != nil {
+		fmt.Println("failed to write audit log: ", err)
 	}
 }
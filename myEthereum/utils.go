@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ecdsa"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -8,10 +9,15 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
 )
@@ -21,25 +27,95 @@ import (
 //  0: recharge
 //  1: withdraw
 //  2: centralize
+//  3: sweep, from the hot wallet to the cold wallet
+//  4: refill, from the cold wallet to the hot wallet
+//  5: gas funding, from the gas station to a deposit address for a token sweep
+// sweeps and refills are recorded in the ledger of the cold wallet
+// a centralize of a token sends no ether, Token and TokenAmount record what it sent
 // transaction statuse
 //  0: pending
 //  1: done
+//  2: failed, mined but reverted
+//  3: dropped, never mined
+//  4: replaced, another transaction with the same nonce was mined
+// a settled transaction records the block it was mined in, so it can be
+// rolled back if that block is reorganized away
+// a speed-up or cancel transaction reuses the nonce of the transaction it replaces,
+// the chain is linked through replaces and replacedby
+// a settled transaction records its fee, gasused times effectivegasprice
 type MyTransaction struct {
-	Hash   string `json:"hash"`
-	Type   string `json:"type"`
-	Status string `json:"status"`
-	Amount string `json:"amount"`
+	Hash              string `json:"hash"`
+	Type              string `json:"type"`
+	Status            string `json:"status"`
+	Amount            string `json:"amount"`
+	Created           int64  `json:"created,omitempty"`
+	BlockNumber       uint64 `json:"blocknumber,omitempty"`
+	BlockHash         string `json:"blockhash,omitempty"`
+	From              string `json:"from,omitempty"`
+	To                string `json:"to,omitempty"`
+	Nonce             uint64 `json:"nonce,omitempty"`
+	Gas               uint64 `json:"gas,omitempty"`
+	GasEstimate       uint64 `json:"gasestimate,omitempty"`
+	GasUsed           uint64 `json:"gasused,omitempty"`
+	GasPrice          string `json:"gasprice,omitempty"`
+	GasFeeCap         string `json:"gasfeecap,omitempty"`
+	GasTipCap         string `json:"gastipcap,omitempty"`
+	Replaces          string `json:"replaces,omitempty"`
+	ReplacedBy        string `json:"replacedby,omitempty"`
+	EffectiveGasPrice string `json:"effectivegasprice,omitempty"`
+	Fee               string `json:"fee,omitempty"`
+	Token             string `json:"token,omitempty"`
+	TokenAmount       string `json:"tokenamount,omitempty"`
 }
 
 const (
-	// AcountPoolPath : the file storing account pool information
-	AcountPoolPath = `.\SystemData\addresses.txt`
-	// AccountInfoPath : the file storing account information
-	AccountInfoPath = `.\SystemData\AccountInfo\`
-	// RPCAddress : the rpc address of the chain
-	RPCAddress = "http://localhost:8545"
-	// MainAddress : main address of the system
-	MainAddress = "0xc0093215bec3cbb9522352dcb4e3fa8fd5b665d1"
+	// ConfigPath : the default config file
+	ConfigPath = "config.yaml"
+	// StorageFile : the database in the data directory storing the account pool and users' ledgers
+	StorageFile = "ledger.db"
+	// AcountPoolFile : the legacy file in the data directory storing account pool information, read by the migrator
+	AcountPoolFile = "addresses.txt"
+	// AccountInfoDir : the legacy directory in the data directory storing account information, read by the migrator
+	AccountInfoDir = "AccountInfo"
+	// ReconcilePrefix : the prefix of the adjustment journals written by reconciliation in the data directory
+	ReconcilePrefix = "reconcile-"
+)
+
+const (
+	// DepositScanStart : the first block to scan for deposits when there is no cursor yet
+	DepositScanStart = uint64(0)
+	// DepositScanInterval : the interval between two background deposit scans
+	DepositScanInterval = 15 * time.Second
+	// DropTimeout : how long a transaction may be unknown to the node before it is considered dropped
+	DropTimeout = 30 * time.Minute
+	// ReorgDepth : the number of blocks below the head in which settled transactions are checked for reorgs
+	ReorgDepth = uint64(64)
+	// StuckTimeout : how long a withdrawal may stay pending before it is sped up
+	StuckTimeout = 10 * time.Minute
+	// RebroadcastInterval : the interval between two background checks for stuck withdrawals
+	RebroadcastInterval = time.Minute
+	// RebalanceInterval : the interval between two background checks of the hot wallet's watermarks
+	RebalanceInterval = 10 * time.Minute
+	// ReplaceBumpPercent : the fees of a replacement in percent of the replaced ones
+	ReplaceBumpPercent = 125
+	// MaxGasPrice : the highest gas price or fee cap a replacement may bid
+	MaxGasPrice = int64(500000000000)
+)
+
+const (
+	// WithdrawFeePolicy : who pays the gas of a withdrawal, "platform" or "user"
+	WithdrawFeePolicy = "platform"
+	// GasPriceDelta : added to the suggested gas price of legacy transactions
+	GasPriceDelta = int64(5000000000)
+	// FeeHistoryBlocks : the number of recent blocks the priority fee is derived from
+	FeeHistoryBlocks = uint64(20)
+	// FeeHistoryPercentile : the percentile of the priority fees paid in each recent block
+	FeeHistoryPercentile = float64(50)
+)
+
+const (
+	// SessionTTL : how long a login session lasts
+	SessionTTL = 30 * time.Minute
 )
 
 // ReadFileContent : returns the file content as json
@@ -77,12 +153,45 @@ func ReadFileContent(path string) (*map[string]interface{}, error) {
 	return &datajson, nil
 }
 
-// DecomposeTransaction : returns a MyTransaction
+// DecomposeTransaction : returns a MyTransaction from a signed transaction
 func DecomposeTransaction(client *ethclient.Client, tx *types.Transaction, tp string) (*MyTransaction, error) {
 	hash := tx.Hash().Hex()
 	amount := tx.Value().String()
 
-	return &MyTransaction{Hash: strings.ToLower(hash), Amount: amount, Type: tp, Status: "0"}, nil
+	from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return nil, err
+	}
+
+	mytx := &MyTransaction{
+		Hash:   strings.ToLower(hash),
+		Amount: amount,
+		Type:   tp,
+		Status: "0",
+		From:   strings.ToLower(from.Hex()),
+		To:     strings.ToLower(tx.To().Hex()),
+		Nonce:  tx.Nonce(),
+		Gas:    tx.Gas(),
+	}
+
+	if tx.Type() == types.DynamicFeeTxType {
+		mytx.GasFeeCap = tx.GasFeeCap().String()
+		mytx.GasTipCap = tx.GasTipCap().String()
+	} else {
+		mytx.GasPrice = tx.GasPrice().String()
+	}
+
+	return mytx, nil
+}
+
+// NonceKey : returns the key shared by a transaction and its replacements
+func NonceKey(tx *MyTransaction) string {
+	// transactions saved before senders were recorded cannot be replaced
+	if tx.From == "" {
+		return tx.Hash
+	}
+
+	return tx.From + "/" + strconv.FormatUint(tx.Nonce, 10)
 }
 
 // MapToTransaction : transfer a map to a MyTransactions
@@ -155,3 +264,42 @@ func GetPrivateKey(privateKeyFile, password *string) (*string, error) {
 
 	return &privKey, nil
 }
+
+// LoadPrivateKey : returns the private key of a system address from the keystore
+func LoadPrivateKey(address string) (*ecdsa.PrivateKey, error) {
+	// derived addresses have no key file, their key comes from the master seed
+	var poolaccount *PoolAccount
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		poolaccount, err = GetPoolAccount(tx, address)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("fail to open account pool: " + err.Error())
+	}
+	if poolaccount != nil && poolaccount.Derived {
+		return DeriveKey(poolaccount.Index)
+	}
+
+	return KeystoreKey(address)
+}
+
+// KeystoreKey : returns the private key of address from its key file in the keystore
+func KeystoreKey(address string) (*ecdsa.PrivateKey, error) {
+	if keys == nil {
+		return nil, errors.New("no keystore is configured, sign for " + address + " on the machine holding its key")
+	}
+	account, err := keys.Find(accounts.Account{Address: common.HexToAddress(address)})
+	if err != nil {
+		return nil, errors.New("no key for " + address + " in keystore " + config.KeystoreDir)
+	}
+	mk := account.URL.Path
+	mp := keystorepassword
+
+	keyValue, err := GetPrivateKey(&mk, &mp)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.HexToECDSA(*keyValue)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitOverride : an admin's waiver of the withdrawal limits for one user until Expires
+type LimitOverride struct {
+	Address string `json:"address"`
+	Admin   string `json:"admin"`
+	Reason  string `json:"reason"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+}
+
+// outflowlock keeps two withdrawals of different users from both passing the daily outflow cap
+var outflowlock sync.Mutex
+
+// LockWithdrawal : wait until no other withdrawal of address is running, and no other withdrawal at all
+// while the daily outflow is capped, returns the unlock function
+func LockWithdrawal(address string) func() {
+	unlock := LockUser(address)
+	if config.GlobalDailyLimit == "" {
+		return unlock
+	}
+
+	outflowlock.Lock()
+	return func() {
+		outflowlock.Unlock()
+		unlock()
+	}
+}
+
+// CheckLimits : returns an error if withdrawing value on behalf of address would exceed
+// the user's hourly or daily limits or the hot wallet's daily outflow cap,
+// pending withdrawals and withdraw requests count, failed and dropped ones do not,
+// an override waives the user's limits but never the outflow cap
+func CheckLimits(address string, value *big.Int) error {
+	limits, err := config.Limits()
+	if err != nil {
+		return err
+	}
+	if limits.UserHourly == nil && limits.UserDaily == nil && limits.UserDailyCount == 0 && limits.GlobalDaily == nil {
+		return nil
+	}
+
+	now := time.Now()
+	hourago, dayago := now.Add(-time.Hour).Unix(), now.Add(-24*time.Hour).Unix()
+
+	var override *LimitOverride
+	var hourly, daily, global *big.Int
+	var count int
+	err = store.View(func(tx StorageTx) error {
+		var o LimitOverride
+		found, err := tx.Get(BucketLimitOverrides, strings.ToLower(address), &o)
+		if err != nil {
+			return err
+		}
+		if found && o.Expires > now.Unix() {
+			override = &o
+		}
+
+		if limits.GlobalDaily != nil {
+			global, err = globalOutflowSince(tx, dayago)
+			if err != nil {
+				return err
+			}
+		}
+		if override != nil {
+			return nil
+		}
+
+		info, err := GetAccountInfo(tx, address)
+		if err != nil {
+			return err
+		}
+		requests, err := withdrawRequests(tx, address, true)
+		if err != nil {
+			return err
+		}
+
+		hourly, _ = withdrawnSince(info, requests, hourago)
+		daily, count = withdrawnSince(info, requests, dayago)
+		return nil
+	})
+	if err != nil {
+		return errors.New("fail to check withdrawal limits: " + err.Error())
+	}
+
+	exceeds := func(used, limit *big.Int) bool {
+		return limit != nil && new(big.Int).Add(used, value).Cmp(limit) > 0
+	}
+
+	if exceeds(global, limits.GlobalDaily) {
+		return errors.New("withdrawal limit reached: the platform's daily withdrawal cap is used up, please try again later or contact support")
+	}
+	if override != nil {
+		return nil
+	}
+
+	switch {
+	case exceeds(hourly, limits.UserHourly):
+		return fmt.Errorf("withdrawal limit reached: %s already withdrawn in the last hour, the hourly limit is %s", hourly, limits.UserHourly)
+	case exceeds(daily, limits.UserDaily):
+		return fmt.Errorf("withdrawal limit reached: %s already withdrawn in the last 24 hours, the daily limit is %s", daily, limits.UserDaily)
+	case limits.UserDailyCount > 0 && count >= limits.UserDailyCount:
+		return fmt.Errorf("withdrawal limit reached: %d withdrawals in the last 24 hours, at most %d are allowed", count, limits.UserDailyCount)
+	}
+
+	return nil
+}
+
+// withdrawnSince : returns the amount and number of withdrawals sent or requested since the unix time since,
+// each nonce counting once with the largest amount of its replacement chain
+func withdrawnSince(info *AccountInfo, requests []WithdrawRequest, since int64) (*big.Int, int) {
+	withdraws := make(map[string]*big.Int)
+	for i := range info.Transactions {
+		tx := &info.Transactions[i]
+		if tx.Type != "1" || (tx.Status != "0" && tx.Status != "1") || tx.Created < since {
+			continue
+		}
+
+		amount, err := ParseAmount(tx.Amount)
+		if err != nil {
+			continue
+		}
+
+		key := NonceKey(tx)
+		if withdrawn, ok := withdraws[key]; !ok || withdrawn.Cmp(amount) < 0 {
+			withdraws[key] = amount
+		}
+	}
+
+	withdrawn := new(big.Int)
+	for _, amount := range withdraws {
+		withdrawn.Add(withdrawn, amount)
+	}
+	count := len(withdraws)
+
+	for _, request := range requests {
+		if request.Created < since {
+			continue
+		}
+		if amount, err := ParseAmount(request.Value); err == nil {
+			withdrawn.Add(withdrawn, amount)
+			count++
+		}
+	}
+
+	return withdrawn, count
+}
+
+// globalOutflowSince : returns the amount the hot wallet has sent in withdrawals since the unix time since
+func globalOutflowSince(tx StorageTx, since int64) (*big.Int, error) {
+	keys, err := tx.Keys(BucketAccountInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	outflow := new(big.Int)
+	for _, key := range keys {
+		info, err := GetAccountInfo(tx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		withdrawn, _ := withdrawnSince(info, nil, since)
+		outflow.Add(outflow, withdrawn)
+	}
+
+	return outflow, nil
+}
+
+// GrantOverride : waive the withdrawal limits of address for duration, replacing any earlier override
+func GrantOverride(session *Session, address string, duration time.Duration, reason string) (*LimitOverride, error) {
+	if reason == "" {
+		return nil, errors.New("an override needs a reason")
+	}
+	if duration <= 0 || duration > 7*24*time.Hour {
+		return nil, errors.New("an override lasts more than 0 and at most 168 hours")
+	}
+
+	now := time.Now()
+	override := LimitOverride{
+		Address: strings.ToLower(address),
+		Admin:   session.Name,
+		Reason:  reason,
+		Created: now.Unix(),
+		Expires: now.Add(duration).Unix(),
+	}
+
+	err := store.Update(func(tx StorageTx) error {
+		account, err := GetPoolAccount(tx, address)
+		if err != nil {
+			return err
+		}
+		if account == nil || account.Status != "1" {
+			return errors.New(address + " is not a user address")
+		}
+
+		return tx.Put(BucketLimitOverrides, override.Address, &override)
+	})
+	if err != nil {
+		return nil, errors.New("fail to grant override: " + err.Error())
+	}
+
+	return &override, nil
+}
+
+// RevokeOverride : end the override of address before it expires
+func RevokeOverride(address string) error {
+	err := store.Update(func(tx StorageTx) error {
+		found, err := tx.Get(BucketLimitOverrides, strings.ToLower(address), &LimitOverride{})
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New(address + " has no override")
+		}
+
+		return tx.Delete(BucketLimitOverrides, strings.ToLower(address))
+	})
+	if err != nil {
+		return errors.New("fail to revoke override: " + err.Error())
+	}
+
+	return nil
+}
+
+// GetOverrides : returns the overrides that have not expired
+func GetOverrides() ([]LimitOverride, error) {
+	overrides := []LimitOverride{}
+	err := store.View(func(tx StorageTx) error {
+		keys, err := tx.Keys(BucketLimitOverrides)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			var override LimitOverride
+			if _, err := tx.Get(BucketLimitOverrides, key, &override); err != nil {
+				return err
+			}
+			if override.Expires > time.Now().Unix() {
+				overrides = append(overrides, override)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open overrides: " + err.Error())
+	}
+
+	return overrides, nil
+}
+
+// FormatOverride : returns an override as one line
+func FormatOverride(override LimitOverride) string {
+	return fmt.Sprintf("%s\tby %s until %s\t%s", override.Address, override.Admin,
+		time.Unix(override.Expires, 0).Format("2006-01-02 15:04:05"), override.Reason)
+}
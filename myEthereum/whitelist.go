@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// WhitelistAddress : a destination a user may withdraw to once Usable has passed
+type WhitelistAddress struct {
+	Address string `json:"address"`
+	Label   string `json:"label,omitempty"`
+	Added   int64  `json:"added"`
+	Usable  int64  `json:"usable"`
+}
+
+// ParseChecksumAddress : returns address if it is a 0x prefixed address in its EIP-55 checksum form,
+// so that a mistyped character is caught instead of sending to another address
+func ParseChecksumAddress(address string) (common.Address, error) {
+	if !strings.HasPrefix(address, "0x") || !common.IsHexAddress(address) {
+		return common.Address{}, errors.New("invalid address " + address)
+	}
+
+	checksummed := common.HexToAddress(address)
+	if checksummed.Hex() != address {
+		return common.Address{}, errors.New("address " + address + " does not match its EIP-55 checksum, copy it from your wallet as is")
+	}
+
+	return checksummed, nil
+}
+
+// GetWhitelist : returns the withdrawal addresses of user
+func GetWhitelist(user string) ([]WhitelistAddress, error) {
+	whitelist := []WhitelistAddress{}
+	err := store.View(func(tx StorageTx) error {
+		keys, err := tx.Keys(BucketWhitelist)
+		if err != nil {
+			return err
+		}
+
+		prefix := strings.ToLower(user) + "/"
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			var entry WhitelistAddress
+			if _, err := tx.Get(BucketWhitelist, key, &entry); err != nil {
+				return err
+			}
+			whitelist = append(whitelist, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("fail to open whitelist: " + err.Error())
+	}
+
+	return whitelist, nil
+}
+
+// AddWhitelistAddress : add a withdrawal address of user, usable once the cool-down has passed
+func AddWhitelistAddress(user, address, label string) (*WhitelistAddress, error) {
+	checksummed, err := ParseChecksumAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if checksummed == (common.Address{}) {
+		return nil, errors.New("cannot withdraw to the zero address")
+	}
+
+	now := time.Now()
+	entry := WhitelistAddress{
+		Address: checksummed.Hex(),
+		Label:   label,
+		Added:   now.Unix(),
+		Usable:  now.Add(config.Cooldown()).Unix(),
+	}
+
+	err = store.Update(func(tx StorageTx) error {
+		found, err := tx.Get(BucketWhitelist, whitelistKey(user, address), &WhitelistAddress{})
+		if err != nil {
+			return err
+		}
+		if found {
+			return errors.New(address + " is already whitelisted")
+		}
+
+		return tx.Put(BucketWhitelist, whitelistKey(user, address), &entry)
+	})
+	if err != nil {
+		return nil, errors.New("fail to add whitelist address: " + err.Error())
+	}
+
+	return &entry, nil
+}
+
+// RemoveWhitelistAddress : remove a withdrawal address of user
+func RemoveWhitelistAddress(user, address string) error {
+	err := store.Update(func(tx StorageTx) error {
+		found, err := tx.Get(BucketWhitelist, whitelistKey(user, address), &WhitelistAddress{})
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New(address + " is not whitelisted")
+		}
+
+		return tx.Delete(BucketWhitelist, whitelistKey(user, address))
+	})
+	if err != nil {
+		return errors.New("fail to remove whitelist address: " + err.Error())
+	}
+
+	return nil
+}
+
+// CheckWhitelisted : returns an error unless user may withdraw to address now
+func CheckWhitelisted(user, address string) error {
+	if !common.IsHexAddress(address) {
+		return errors.New("invalid address " + address)
+	}
+
+	var entry WhitelistAddress
+	found := false
+	err := store.View(func(tx StorageTx) error {
+		var err error
+		found, err = tx.Get(BucketWhitelist, whitelistKey(user, address), &entry)
+		return err
+	})
+	if err != nil {
+		return errors.New("fail to open whitelist: " + err.Error())
+	}
+
+	if !found {
+		return errors.New(address + " is not a whitelisted withdrawal address")
+	}
+	if usable := time.Unix(entry.Usable, 0); time.Now().Before(usable) {
+		return errors.New(address + " is in its cool-down until " + usable.Format("2006-01-02 15:04:05"))
+	}
+
+	return nil
+}
+
+func whitelistKey(user, address string) string {
+	return strings.ToLower(user) + "/" + strings.ToLower(address)
+}